@@ -0,0 +1,57 @@
+package main
+
+import (
+	"io"
+	"os"
+	"os/signal"
+	"sync"
+	"time"
+)
+
+// followInterval is how long --follow waits before looking for more input.
+const followInterval = 250 * time.Millisecond
+
+var (
+	stopFollowing     = make(chan struct{})
+	stopFollowingOnce sync.Once
+
+	// followIdle, if not nil, is called whenever --follow catches up with
+	// the end of an input, to flush out what's been converted so far.
+	followIdle func()
+)
+
+// stopFollowingOnInterrupt makes Ctrl-C end --follow, as if every input had
+// ended there, so that whatever is still open gets closed and the output is
+// finished properly. A second Ctrl-C kills the process as usual.
+func stopFollowingOnInterrupt() {
+	interrupts := make(chan os.Signal, 1)
+	signal.Notify(interrupts, os.Interrupt)
+	go func() {
+		<-interrupts
+		signal.Stop(interrupts)
+		stopFollowingOnce.Do(func() { close(stopFollowing) })
+	}()
+}
+
+// followReader reads a file like tail -f: at the end of the file, it waits
+// for more to be written instead of stopping, until it's told to stop.
+type followReader struct {
+	io.ReadCloser
+}
+
+func (fr *followReader) Read(p []byte) (int, error) {
+	for {
+		n, err := fr.ReadCloser.Read(p)
+		if n > 0 || err != io.EOF {
+			return n, err
+		}
+		if followIdle != nil {
+			followIdle()
+		}
+		select {
+		case <-stopFollowing:
+			return 0, io.EOF
+		case <-time.After(followInterval):
+		}
+	}
+}
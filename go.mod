@@ -4,10 +4,8 @@ go 1.19
 
 require (
 	github.com/spf13/cobra v1.6.0
+	github.com/spf13/pflag v1.0.5
 	golang.org/x/exp v0.0.0-20221012211006-4de253d81b95
 )
 
-require (
-	github.com/inconshreveable/mousetrap v1.0.1 // indirect
-	github.com/spf13/pflag v1.0.5 // indirect
-)
+require github.com/inconshreveable/mousetrap v1.0.1 // indirect
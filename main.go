@@ -2,35 +2,202 @@ package main
 
 import (
 	"bufio"
-	"encoding/json"
+	"bytes"
+	"compress/gzip"
+	"errors"
 	"fmt"
 	"io"
+	"net/http"
 	"os"
+	"path/filepath"
+	"regexp"
+	"runtime/pprof"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/bvisness/chrome2spall/pkg/chrome2spall"
 	"github.com/spf13/cobra"
-	"golang.org/x/exp/constraints"
 )
 
 var rootCmd *cobra.Command
 
+// version is set at build time, with -ldflags "-X main.version=v1.2.3".
+var version = "dev"
+
+var (
+	format      string
+	outputPath  string
+	tee         bool
+	showIdle    bool
+	keepProgram bool
+	withURL     bool
+	minDuration time.Duration
+	pidFilter   []int
+	tidFilter   []int
+	startMs     float64
+	endMs       float64
+	sinceMarker string
+	untilMarker string
+	showStats   bool
+	manifestOut string
+	category    string
+	quiet       bool
+	force       bool
+	pretty      bool
+
+	sampleInterval    string
+	collapseRecursion bool
+	expandComplete    bool
+	timeout           time.Duration
+	count             bool
+	emitArgs          bool
+	timestampUnit     string
+	rebaseZero        bool
+	includeNative     bool
+	splitDir          string
+	streaming         bool
+	colorBy           string
+	mainOnly          bool
+	maxDepth          int
+	wrap              bool
+	appendOutput      bool
+	displayUnit       string
+	nameTemplate      string
+	smooth            int
+	progress          string
+	gcAsSibling       bool
+	flows             bool
+	trackByOrigin     bool
+	concurrencyTrack  bool
+	downsample        int
+	mergeThreads      bool
+	selfTime          bool
+	maxEvents         int
+	completeEvents    bool
+	follow            bool
+	validateOutput    bool
+	keepCategories    []string
+	excludeFunctions  []string
+	dropCategories    []string
+	inputFormat       string
+	tagKind           bool
+	profileSelf       string
+	appPrefix         string
+	jobs              int
+	remapPids         []string
+	remapTids         []string
+)
+
 func main() {
 	rootCmd = &cobra.Command{
-		Use:   "chrome2spall [myprofile.json]",
+		Use:   "chrome2spall [myprofile.json|URL|DIR...]",
 		Short: "A not particularly efficient utility to convert Chrome's performance profiles into spall files.",
-		Args:  cobra.MatchAll(cobra.MaximumNArgs(1), cobra.OnlyValidArgs),
+		Long: `A not particularly efficient utility to convert Chrome's performance profiles into spall files.
+
+When given multiple profiles, they are merged into a single output. To keep
+processes from different files apart, the pids from the Nth file (counting
+from zero) are offset by N*10000000.
+
+With no profiles, or "-", the profile is read from stdin. Put "--" before a
+file name that starts with a dash.`,
+		Args: cobra.OnlyValidArgs,
 		Run: func(cmd *cobra.Command, args []string) {
-			if len(args) == 0 {
-				convertFile(os.Stdin)
-			} else {
-				if f, err := os.Open(args[0]); err == nil {
-					convertFile(f)
-				} else {
-					fmt.Fprintf(os.Stderr, "Could not open file: %v\n", err)
+			if profileSelf != "" {
+				f, err := os.Create(profileSelf)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Could not create profile: %v\n", err)
+					os.Exit(1)
 				}
+				if err := pprof.StartCPUProfile(f); err != nil {
+					fmt.Fprintf(os.Stderr, "Could not start profiling: %v\n", err)
+					os.Exit(1)
+				}
+			}
+
+			err := run(args)
+			if profileSelf != "" {
+				pprof.StopCPUProfile()
+			}
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
 			}
 		},
 	}
+	rootCmd.Version = version
+	rootCmd.AddCommand(&cobra.Command{
+		Use:   "version",
+		Short: "Print the version of chrome2spall",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			fmt.Println(version)
+		},
+	})
+	// Having a subcommand gets us cobra's completion command too.
+
+	rootCmd.Flags().StringVar(&format, "format", "json", "output format: json (trace events), binary (native .spall), or perfetto (Perfetto protobuf)")
+	rootCmd.Flags().BoolVar(&pretty, "pretty", false, "indent each event in the JSON output to make it easier to read")
+	rootCmd.Flags().BoolVar(&wrap, "wrap", false, "write the JSON output as a strictly valid {\"traceEvents\":[...]} document")
+	rootCmd.Flags().BoolVar(&appendOutput, "append", false, "add to the output file instead of replacing it, if it already has something in it")
+	rootCmd.Flags().StringVar(&displayUnit, "display-unit", "ms", "time unit (ms or ns) for viewers to show in the --wrap output")
+	rootCmd.Flags().StringVarP(&outputPath, "output", "o", "", "write output to this file instead of stdout")
+	rootCmd.Flags().BoolVar(&tee, "tee", false, "with -o, write the output to stdout as well")
+	rootCmd.Flags().StringVar(&splitDir, "split-by-pid", "", "write each process to its own file in this directory, instead of one combined output")
+	rootCmd.Flags().DurationVar(&timeout, "timeout", 0, "give up on downloading a trace from a URL after this long (0 for no limit)")
+	rootCmd.Flags().BoolVar(&count, "count", false, "don't convert anything; just describe what's in each process of the input")
+	rootCmd.Flags().BoolVar(&showStats, "stats", false, "print a summary of the conversion to stderr")
+	rootCmd.Flags().StringVar(&manifestOut, "manifest", "", "also write a JSON file describing the conversion: its inputs and their hashes, flags, and processes")
+	rootCmd.Flags().IntVarP(&jobs, "jobs", "j", 0, "convert this many profiles in parallel (0 to convert serially, streaming out events as they're ready)")
+	rootCmd.Flags().BoolVar(&streaming, "streaming", false, "convert in bounded memory, however big the input is (can't be combined with --jobs)")
+	rootCmd.Flags().BoolVar(&force, "force", false, "convert the input even if it doesn't look like a Chrome trace")
+	rootCmd.Flags().StringVar(&progress, "progress", "never", "show how far along each input is on stderr: auto (only on a terminal), always, or never")
+	rootCmd.Flags().Lookup("progress").NoOptDefVal = "auto"
+	rootCmd.Flags().BoolVarP(&quiet, "quiet", "q", false, "don't print a warning for every bad event, just a count at the end")
+	rootCmd.Flags().StringVar(&inputFormat, "input-format", "auto", "layout of the input, instead of working it out: ndjson, array, object (with traceEvents), or cpuprofile, plus +gz if it's gzipped")
+	rootCmd.Flags().StringVar(&timestampUnit, "timestamp-unit", "us", "unit of the input's timestamps: us, ns, or ms")
+	rootCmd.Flags().IntSliceVar(&pidFilter, "pid", nil, "only convert events from this process (repeatable)")
+	rootCmd.Flags().BoolVar(&mainOnly, "main-only", false, "only convert the process that rendered the page's main frame")
+	rootCmd.Flags().IntSliceVar(&tidFilter, "tid", nil, "only convert events from this thread (repeatable)")
+	rootCmd.Flags().Float64Var(&startMs, "start", 0, "drop everything before this many milliseconds after the trace's first event")
+	rootCmd.Flags().Float64Var(&endMs, "end", 0, "drop everything after this many milliseconds after the trace's first event (0 for no limit)")
+	rootCmd.Flags().StringVar(&sinceMarker, "since-marker", "", "drop everything before the first marker with this name, like a console.timeStamp label")
+	rootCmd.Flags().StringVar(&untilMarker, "until-marker", "", "drop everything after the first marker with this name (after --since-marker)")
+	rootCmd.Flags().StringSliceVar(&remapPids, "remap", nil, "replace pids in the output, as old:new pairs (e.g. 1234:1,775:2)")
+	rootCmd.Flags().StringSliceVar(&remapTids, "remap-tid", nil, "replace tids in the output, as old:new pairs")
+	rootCmd.Flags().BoolVar(&rebaseZero, "rebase-zero", false, "shift all timestamps so that the output starts at zero")
+	rootCmd.Flags().DurationVar(&minDuration, "min-duration", 0, "drop frames shorter than this (e.g. 50us)")
+	rootCmd.Flags().StringVar(&category, "category", "function", "category (cat) for emitted frames; "+chrome2spall.OriginPlaceholder+" is replaced by the frame's script origin")
+	rootCmd.Flags().BoolVar(&tagKind, "tag-kind", false, "add the kind of code (js, native, gc, or idle) to each frame's category, like function,js")
+	rootCmd.Flags().StringVar(&colorBy, "color-by", "", "set to origin to color each frame by its script's origin (JSON output only)")
+	rootCmd.Flags().StringVar(&appPrefix, "app-prefix", "", "with --color-by, color scripts whose URL starts with this as app code, and everything else as vendor code")
+	rootCmd.Flags().StringVar(&sampleInterval, "sample-interval", "", "set to auto to let the last sample of a profile run for one (median) sampling interval, so single-sample frames at the end have a width")
+	rootCmd.Flags().BoolVar(&expandComplete, "expand-complete", false, "convert complete (X) events into begin/end pairs instead of passing them through")
+	rootCmd.Flags().StringVar(&nameTemplate, "name-template", "", "name frames with this Go template, using .FunctionName, .URL, .Line, .Col, .ScriptID, and .CodeType (e.g. '{{.URL}}:{{.Line}} {{.FunctionName}}')")
+	rootCmd.Flags().BoolVar(&withURL, "with-url", false, "append the source URL and line to every function name")
+	rootCmd.Flags().BoolVar(&emitArgs, "emit-args", false, "attach each frame's source location (url, line, col, scriptId) to it as args")
+	rootCmd.Flags().BoolVar(&keepProgram, "keep-program", false, "emit V8's (program) pseudo-frames instead of treating them as empty stacks")
+	rootCmd.Flags().BoolVar(&includeNative, "include-native", true, "emit frames for native engine code (set to false to leave them out, keeping garbage collection)")
+	rootCmd.Flags().IntVar(&maxDepth, "max-depth", 0, "leave out frames more than this many levels deep (0 for no limit)")
+	rootCmd.Flags().IntVar(&smooth, "smooth", 0, "ignore stacks that change for at most this many samples before changing back, trading a little accuracy for readability")
+	rootCmd.Flags().BoolVar(&collapseRecursion, "collapse-recursion", false, "merge a function's directly recursive calls into a single frame")
+	rootCmd.Flags().BoolVar(&gcAsSibling, "gc-as-sibling", false, "show garbage collections on their own instead of nested under the JS that triggered them")
+	rootCmd.Flags().StringArrayVar(&excludeFunctions, "exclude-function", nil, "leave out frames whose names match this regular expression, showing what they call under their caller instead (repeatable)")
+	rootCmd.Flags().StringSliceVar(&keepCategories, "keep-categories", nil, "pass through only the other events with one of these categories")
+	rootCmd.Flags().StringSliceVar(&dropCategories, "drop-categories", nil, "leave out the other events with any of these categories")
+	rootCmd.Flags().BoolVar(&trackByOrigin, "track-by-origin", false, "put each script origin's frames on a track of its own (calls between origins are no longer nested)")
+	rootCmd.Flags().BoolVar(&validateOutput, "validate-output", false, "check the output file afterwards for unbalanced or out-of-order frames")
+	rootCmd.Flags().BoolVar(&follow, "follow", false, "keep reading input files as they grow, like tail -f, until interrupted with Ctrl-C")
+	rootCmd.Flags().BoolVar(&completeEvents, "complete-events", false, "write each frame as one complete (X) event instead of a begin and an end, to halve the size of JSON output")
+	rootCmd.Flags().IntVar(&maxEvents, "max-events", 0, "stop after writing this many begin and end events, for a quick preview")
+	rootCmd.Flags().BoolVar(&selfTime, "self-time", false, "attach each frame's self time (without its children) to it as an arg")
+	rootCmd.Flags().BoolVar(&mergeThreads, "merge-threads", false, "put all of each process's threads on one track, labeling each frame with its tid")
+	rootCmd.Flags().IntVar(&downsample, "downsample", 0, "keep only every Nth sample of each profile, for profiles too big to open")
+	rootCmd.Flags().BoolVar(&concurrencyTrack, "concurrency-track", false, "add a track showing how many threads were busy over time")
+	rootCmd.Flags().BoolVar(&flows, "flows", false, "convert flow and async events into markers labeled with their ids")
+	rootCmd.Flags().StringVar(&profileSelf, "profile-self", "", "write a Go CPU profile of the conversion to this file")
+	rootCmd.Flags().MarkHidden("profile-self")
+	rootCmd.Flags().BoolVar(&showIdle, "show-idle", false, "show idle time as explicit (idle) frames instead of gaps")
 
 	if err := rootCmd.Execute(); err != nil {
 		fmt.Fprintln(os.Stderr, err)
@@ -38,279 +205,602 @@ func main() {
 	}
 }
 
-func convertFile(r io.Reader) {
-	fmt.Println("[")
-	defer fmt.Println("]")
+func run(args []string) error {
+	if follow {
+		if jobs > 0 {
+			return errors.New("--follow converts the input as it comes in, so it can't be combined with --jobs")
+		}
+		stopFollowingOnInterrupt()
+	}
 
-	type profileState struct {
-		Pid, Tid int
-		Time     int64
-		Nodes    map[int]Node
-		Stack    []int
+	if validateOutput && (outputPath == "" || count || splitDir != "") {
+		return errors.New("--validate-output needs an output file (-o) to read back")
+	}
+	if validateOutput && format != "json" && format != "binary" {
+		return fmt.Errorf("--validate-output can only read back json and binary output, not %s", format)
+	}
+	if count || splitDir != "" {
+		return convertFiles(args, io.Discard, format, false)
 	}
-	profiles := make(map[int]*profileState)
 
-	scanner := bufio.NewScanner(r)
-	for scanner.Scan() {
-		line := scanner.Text()
-		line = strings.Trim(line, "[],\n")
+	if tee && outputPath == "" {
+		return errors.New("--tee needs an output file (-o) to write to besides stdout")
+	}
+	if tee && appendOutput {
+		return errors.New("--tee can't be combined with --append, since stdout would only get the appended part")
+	}
 
-		var event Event
-		err := json.Unmarshal([]byte(line), &event)
+	var output io.WriteCloser
+	var appending bool
+	var err error
+	if appendOutput {
+		if outputPath == "" {
+			return errors.New("--append needs an output file (-o)")
+		}
+		output, appending, err = openAppend(outputPath, format, wrap)
 		if err != nil {
-			fmt.Fprintln(os.Stderr, "Error reading event:", err)
-			continue
+			return fmt.Errorf("Could not append to output file: %v", err)
 		}
+	} else {
+		output, err = openOutput(outputPath)
+		if err != nil {
+			return fmt.Errorf("Could not create output file: %v", err)
+		}
+	}
+	if tee {
+		stdout, _ := openOutput("")
+		output = newTeeOutput(output, stdout)
+	}
 
-		if event.IsSpecialEvent(SpecialEventProfile) {
-			var args ProfileArgs
-			err := json.Unmarshal(event.Args, &args)
-			if err != nil {
-				fmt.Fprintln(os.Stderr, "Failed to read Profile event:", err)
-				continue
+	if follow {
+		followIdle = func() {
+			if f, ok := output.(interface{ Flush() error }); ok {
+				f.Flush()
 			}
+		}
+	}
+	err = convertFiles(args, output, format, appending)
+	if cerr := output.Close(); err == nil && cerr != nil {
+		err = fmt.Errorf("error writing output: %w", cerr)
+	}
+	if err == nil && validateOutput {
+		err = validate(outputPath, format)
+	}
+	return err
+}
 
-			profiles[event.Pid] = &profileState{
-				Pid:   event.Pid,
-				Tid:   event.Tid,
-				Time:  args.Data.StartTime,
-				Nodes: make(map[int]Node),
-			}
-		} else if event.IsSpecialEvent(SpecialEventProfileChunk) {
-			var args ProfileChunkArgs
-			err := json.Unmarshal(event.Args, &args)
-			if err != nil {
-				fmt.Fprintln(os.Stderr, "Failed to read ProfileChunk event:", err)
-				continue
-			}
+// validate reads back the output for --validate-output.
+func validate(path, format string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("Could not validate output: %v", err)
+	}
+	defer f.Close()
+	if err := chrome2spall.Validate(f, format); errors.Is(err, chrome2spall.ErrCannotValidate) {
+		return fmt.Errorf("Could not validate output: %v", err)
+	} else if err != nil {
+		return fmt.Errorf("%s is malformed: %w", path, err)
+	}
+	if !quiet {
+		fmt.Fprintf(os.Stderr, "%s is well-formed\n", path)
+	}
+	return nil
+}
 
-			profile, ok := profiles[event.Pid]
-			if !ok {
-				fmt.Fprintf(os.Stderr, "Got an event for pid %v, but we never saw a Profile event for that pid\n", event.Pid)
-				continue
-			}
+// openInput opens a trace for reading, transparently decompressing it if it
+// was gzipped. The path may also be an http:// or https:// URL. An empty path
+// means stdin.
+func openInput(path string) (io.ReadCloser, error) {
+	var f io.ReadCloser
+	var size int64 = -1 // unknown
+	gzipped := strings.HasSuffix(path, ".gz")
+	if path == "" {
+		f = os.Stdin
+	} else if strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://") {
+		var err error
+		f, size, err = fetch(path)
+		if err != nil {
+			return nil, err
+		}
+		// The HTTP client may have already decompressed the response, so go
+		// by the contents rather than the name.
+		gzipped = false
+	} else {
+		if info, err := os.Stat(path); err == nil && info.Mode()&os.ModeNamedPipe != 0 && !quiet {
+			// Opening a FIFO blocks until something opens it to write, so
+			// say why nothing's happening.
+			fmt.Fprintf(os.Stderr, "Waiting for something to write to %s...\n", path)
+		}
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		regular := false
+		if info, err := file.Stat(); err == nil && info.Mode().IsRegular() {
+			size = info.Size()
+			regular = true
+		}
+		f = file
+		if follow && regular {
+			// Stdin, pipes, and URLs already wait for more input by
+			// themselves, and their end really is the end.
+			f = &followReader{file}
+			size = -1
+		}
+	}
 
-			for _, node := range args.Data.CPUProfile.Nodes {
-				profile.Nodes[node.ID] = node
-			}
+	if manifestOut != "" {
+		name := path
+		if name == "" {
+			name = "stdin"
+		}
+		f = newHashingReader(f, name)
+	}
+	if showProgress() {
+		name := path
+		if name == "" {
+			name = "stdin"
+		}
+		// Count the bytes before they're decompressed, so that they add up
+		// to the size of the file.
+		f = newProgressReader(f, name, size)
+	}
 
-			for i := range args.Data.CPUProfile.Samples {
-				topNodeID := args.Data.CPUProfile.Samples[i]
-				topNode := profile.Nodes[topNodeID]
-				timeDelta := args.Data.TimeDeltas[i]
+	// An --input-format decides for itself whether the input is gzipped.
+	layout, forceGzip := inputLayout()
+	if layout != "auto" {
+		gzipped = forceGzip
+	}
 
-				profile.Time += timeDelta
+	br := bufio.NewReader(f)
+	if gzipped || (layout == "auto" && isGzip(br)) {
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		return &gzipFile{Reader: zr, f: f}, nil
+	}
+	return &bufferedInput{Reader: br, f: f}, nil
+}
 
-				currentTopID := 0
-				if len(profile.Stack) > 0 {
-					currentTopID = profile.Stack[len(profile.Stack)-1]
-				}
+// inputLayout splits --input-format into the layout of the trace, and
+// whether it's gzipped.
+func inputLayout() (layout string, gzipped bool) {
+	if strings.HasSuffix(inputFormat, "+gz") {
+		return strings.TrimSuffix(inputFormat, "+gz"), true
+	}
+	return inputFormat, false
+}
 
-				if currentTopID == topNodeID {
-					// no change, keep on ticking
-				} else if topNode.CallFrame.CodeType == "other" && topNode.CallFrame.FunctionName == "(garbage collector)" {
-					// Garbage collections are special. Don't treat them as a
-					// stack change; push them as new events unconditionally.
-					// They'll be popped by the next legitimate event.
-					beginEvent := Event{
-						Category: "function",
-						Name:     topNode.CallFrame.FunctionName,
-						Type:     "B",
-						Pid:      event.Pid,
-						Tid:      event.Tid,
-						Time:     profile.Time,
-					}
-					fmt.Printf("%s,\n", string(must1(json.Marshal(beginEvent))))
-					profile.Stack = append(profile.Stack, topNodeID)
-				} else {
-					// Stack change! Starting at new top node, follow parents
-					// until you find an ancestor already in the stack (or
-					// exhaust the stack.) Pop the stack back to that ancestor,
-					// emitting end events. Then push all new nodes to the
-					// stack, emitting begin events.
-
-					// This will track the topmost node we want to keep.
-					ancestorIndex := -1
-
-					// First see if the top node is _in_ the stack. This means
-					// we are purely popping.
-					for i, id := range profile.Stack {
-						if id == topNodeID {
-							ancestorIndex = i
-						}
-					}
-
-					var nodesToBegin []int
-
-					// If we didn't find an ancestor yet, that means this is a
-					// new event. Starting from that new event, work back
-					// through the chain of parents until we find something in
-					// the stack.
-					if ancestorIndex < 0 {
-						newTopNode := profile.Nodes[topNodeID]
-						currentNodeID := newTopNode.ID
-
-					findancestor:
-						for currentNodeID != 0 {
-							for i := len(profile.Stack) - 1; i >= 0; i-- {
-								stackNode := profile.Stack[i]
-								if stackNode == currentNodeID {
-									ancestorIndex = i
-									break findancestor
-								}
-							}
-
-							nodesToBegin = append(nodesToBegin, currentNodeID)
-							currentNodeID = profile.Nodes[currentNodeID].Parent
-						}
-					}
-
-					// Now, pop back to the ancestor...
-					for i := len(profile.Stack) - 1; i > ancestorIndex; i-- {
-						endEvent := Event{
-							Category: "function",
-							Type:     "E",
-							Pid:      event.Pid,
-							Tid:      event.Tid,
-							Time:     profile.Time - int64(min(i-ancestorIndex, 49)), // fudge for spall's unstable sorts
-						}
-						fmt.Printf("%s,\n", string(must1(json.Marshal(endEvent))))
-						profile.Stack = profile.Stack[:i]
-					}
-
-					// And then push the new events.
-					for i := len(nodesToBegin) - 1; i >= 0; i-- {
-						nodeID := nodesToBegin[i]
-						node := profile.Nodes[nodeID]
-						cf := node.CallFrame
-						name := cf.FunctionName
-						if name == "" {
-							name = fmt.Sprintf("(anonymous %d:%d:%d)", cf.ScriptID, cf.LineNumber, cf.ColumnNumber)
-						}
-						beginEvent := Event{
-							Category: "function",
-							Name:     name,
-							Type:     "B",
-							Pid:      event.Pid,
-							Tid:      event.Tid,
-							Time:     profile.Time + int64(min(len(nodesToBegin)-i, 49)), // fudge for spall's unstable sorts
-						}
-						fmt.Printf("%s,\n", string(must1(json.Marshal(beginEvent))))
-						profile.Stack = append(profile.Stack, nodeID)
-					}
-				}
-			}
-		} else {
-			// pass the line through unchanged
-			fmt.Printf("%s,\n", line)
-		}
+// fetch starts downloading a trace, giving up after --timeout. It also
+// returns the size of the download, or -1 if the server didn't say.
+func fetch(url string) (io.ReadCloser, int64, error) {
+	client := &http.Client{Timeout: timeout}
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, 0, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, 0, fmt.Errorf("%s: %s", url, resp.Status)
 	}
-	if err := scanner.Err(); err != nil {
-		fmt.Fprintln(os.Stderr, "reading standard input:", err)
+	size := resp.ContentLength
+	if resp.Uncompressed {
+		// The length is of the compressed body, which we never see.
+		size = -1
 	}
+	return resp.Body, size, nil
+}
 
-	// Pop everything left on the stacks
-	for _, profile := range profiles {
-		for i := len(profile.Stack) - 1; i >= 0; i-- {
-			endEvent := Event{
-				Category: "function",
-				Type:     "E",
-				Pid:      profile.Pid,
-				Tid:      profile.Tid,
-				Time:     profile.Time - int64(i), // fudge for spall's unstable sorts
-			}
-			fmt.Printf("%s,\n", string(must1(json.Marshal(endEvent))))
-			profile.Stack = profile.Stack[:i]
-		}
+func isGzip(br *bufio.Reader) bool {
+	magic, err := br.Peek(2)
+	return err == nil && magic[0] == 0x1f && magic[1] == 0x8b
+}
+
+type bufferedInput struct {
+	*bufio.Reader
+	f io.Closer
+}
+
+func (bi *bufferedInput) Close() error {
+	return bi.f.Close()
+}
+
+type gzipFile struct {
+	*gzip.Reader
+	f io.Closer
+}
+
+func (gf *gzipFile) Close() error {
+	err := gf.Reader.Close()
+	if cerr := gf.f.Close(); err == nil {
+		err = cerr
 	}
+	return err
 }
 
-type Event struct {
-	Name     string          `json:"name"`
-	Category string          `json:"cat"`
-	Type     string          `json:"ph"`
-	Time     int64           `json:"ts"`
-	Pid      int             `json:"pid"`
-	Tid      int             `json:"tid"`
-	Args     json.RawMessage `json:"args"`
+// openOutput opens the destination for converted events. An empty path means
+// stdout. Either way the output is buffered, since we write a great many
+// small events.
+func openOutput(path string) (io.WriteCloser, error) {
+	if path == "" {
+		return &bufferedOutput{Writer: bufio.NewWriter(os.Stdout)}, nil
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	return &bufferedOutput{Writer: bufio.NewWriter(f), f: f}, nil
 }
 
-func (e *Event) Categories() []string {
-	return strings.Split(e.Category, ",")
+// openAppend opens an output for --append, creating it if necessary, and
+// reports whether there's anything already in it to add to. A JSON output
+// has its closing bracket cut off, so that new events go inside the array.
+func openAppend(path, format string, wrap bool) (io.WriteCloser, bool, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o666)
+	if err != nil {
+		return nil, false, err
+	}
+	end, err := appendOffset(f, format, wrap)
+	if err == nil {
+		err = f.Truncate(end)
+	}
+	if err == nil {
+		_, err = f.Seek(end, io.SeekStart)
+	}
+	if err != nil {
+		f.Close()
+		return nil, false, fmt.Errorf("%s: %w", path, err)
+	}
+	return &bufferedOutput{Writer: bufio.NewWriter(f), f: f}, end > 0, nil
 }
 
-func (e *Event) HasCategory(cat string) bool {
-	for _, ecat := range e.Categories() {
-		if cat == ecat {
-			return true
+// appendOffset works out where new events go in an existing output, after
+// checking that it's in the format that's about to be written. Zero means to
+// start the output over.
+func appendOffset(f *os.File, format string, wrap bool) (int64, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	size := info.Size()
+	if size == 0 {
+		return 0, nil
+	}
+
+	var first [1]byte
+	if _, err := f.ReadAt(first[:], 0); err != nil {
+		return 0, err
+	}
+	isJSON := first[0] == '[' || first[0] == '{'
+	if format != "json" {
+		if isJSON {
+			return 0, fmt.Errorf("can't append %s output to JSON", format)
 		}
+		return size, nil
+	}
+	if !isJSON {
+		return 0, errors.New("can't append JSON output to a binary file")
 	}
-	return false
-}
 
-func (e *Event) IsSpecialEvent(se SpecialEvent) bool {
-	return e.HasCategory(se.Cat) && e.Type == se.Type && e.Name == se.Name
+	// The closing bracket is near the end, followed by displayTimeUnit if
+	// the output was wrapped.
+	start := size - 4096
+	if start < 0 {
+		start = 0
+	}
+	tail := make([]byte, size-start)
+	if _, err := f.ReadAt(tail, start); err != nil {
+		return 0, err
+	}
+	closing := bytes.LastIndexByte(tail, ']')
+	wellFormed := closing >= 0 && wrap == (first[0] == '{')
+	if wellFormed {
+		rest := strings.TrimSpace(string(tail[closing+1:]))
+		if wrap {
+			wellFormed = strings.HasPrefix(rest, `,"displayTimeUnit":`)
+		} else {
+			wellFormed = rest == ""
+		}
+	}
+	if !wellFormed {
+		return 0, errors.New("doesn't end like chrome2spall's JSON output (was it written with the same --wrap?)")
+	}
+	if bytes.HasSuffix(bytes.TrimSpace(tail[:closing]), []byte("[")) {
+		// There are no events yet, so there's nothing to keep.
+		return 0, nil
+	}
+	return start + int64(closing), nil
 }
 
-type SpecialEvent struct {
-	Cat, Type, Name string
+type bufferedOutput struct {
+	*bufio.Writer
+	f *os.File // nil for stdout, which we shouldn't close
 }
 
-var (
-	SpecialEventTracingStartedInBrowser = SpecialEvent{"disabled-by-default-devtools.timeline", "I", "TracingStartedInBrowser"}
-	SpecialEventProfile                 = SpecialEvent{"disabled-by-default-v8.cpu_profiler", "P", "Profile"}
-	SpecialEventProfileChunk            = SpecialEvent{"disabled-by-default-v8.cpu_profiler", "P", "ProfileChunk"}
-)
+func (bo *bufferedOutput) Close() error {
+	err := bo.Flush()
+	if bo.f != nil {
+		if cerr := bo.f.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
 
-type ProfileArgs struct {
-	Data ProfileArgsData `json:"data"`
+// teeOutput writes to several outputs at once, for --tee. Each one is
+// buffered on its own.
+type teeOutput struct {
+	io.Writer
+	outputs []io.WriteCloser
 }
 
-type ProfileArgsData struct {
-	StartTime int64 `json:"startTime"`
+func newTeeOutput(outputs ...io.WriteCloser) *teeOutput {
+	writers := make([]io.Writer, len(outputs))
+	for i, o := range outputs {
+		writers[i] = o
+	}
+	return &teeOutput{Writer: io.MultiWriter(writers...), outputs: outputs}
 }
 
-type ProfileChunkArgs struct {
-	Data ProfileChunkArgsData
+// Flush flushes each of the outputs, for --follow.
+func (t *teeOutput) Flush() error {
+	var err error
+	for _, o := range t.outputs {
+		if f, ok := o.(interface{ Flush() error }); ok {
+			if ferr := f.Flush(); err == nil {
+				err = ferr
+			}
+		}
+	}
+	return err
 }
 
-type ProfileChunkArgsData struct {
-	CPUProfile CPUProfile `json:"cpuProfile"`
-	// Lines      []int      `json:"lines"`
-	TimeDeltas []int64 `json:"timeDeltas"`
+func (t *teeOutput) Close() error {
+	var err error
+	for _, o := range t.outputs {
+		if cerr := o.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
 }
 
-type CPUProfile struct {
-	Nodes   []Node `json:"nodes"`
-	Samples []int  `json:"samples"`
+// splitOutput returns a function to open DIR/pid-<n>.<ext> for each process
+// with --split-by-pid, or nil without it.
+func splitOutput(dir, format string) func(pid int) (io.WriteCloser, error) {
+	if dir == "" {
+		return nil
+	}
+	ext := ".json"
+	switch format {
+	case "binary":
+		ext = ".spall"
+	case "perfetto":
+		ext = ".pftrace"
+	}
+	return func(pid int) (io.WriteCloser, error) {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return nil, err
+		}
+		return openOutput(filepath.Join(dir, fmt.Sprintf("pid-%d%s", pid, ext)))
+	}
 }
 
-type Node struct {
-	CallFrame CallFrame `json:"callFrame"`
-	ID        int       `json:"id"`
-	Parent    int       `json:"parent"`
+// convertFiles converts each of the given traces in turn into a single output
+// stream. No paths, or a path of "-", means stdin. appending is set if w already has events in it
+// from before, with --append.
+func convertFiles(paths []string, w io.Writer, format string, appending bool) error {
+	pids, err := parseRemap("--remap", remapPids)
+	if err != nil {
+		return err
+	}
+	tids, err := parseRemap("--remap-tid", remapTids)
+	if err != nil {
+		return err
+	}
+
+	layout, _ := inputLayout()
+
+	suppressed := 0
+	opts := chrome2spall.Options{
+		Format:            format,
+		InputFormat:       layout,
+		SplitOutput:       splitOutput(splitDir, format),
+		Pretty:            pretty,
+		Wrap:              wrap,
+		Append:            appending,
+		DisplayUnit:       displayUnit,
+		TimestampUnit:     timestampUnit,
+		Pids:              pidFilter,
+		Tids:              tidFilter,
+		MainOnly:          mainOnly,
+		Start:             time.Duration(startMs * float64(time.Millisecond)),
+		End:               time.Duration(endMs * float64(time.Millisecond)),
+		SinceMarker:       sinceMarker,
+		UntilMarker:       untilMarker,
+		RebaseZero:        rebaseZero,
+		RemapPids:         pids,
+		RemapTids:         tids,
+		MinDuration:       minDuration,
+		Category:          category,
+		TagKind:           tagKind,
+		ColorBy:           colorBy,
+		AppPrefix:         appPrefix,
+		NameTemplate:      nameTemplate,
+		WithURL:           withURL,
+		EmitArgs:          emitArgs,
+		KeepProgram:       keepProgram,
+		SkipNative:        !includeNative,
+		ShowIdle:          showIdle,
+		GCAsSibling:       gcAsSibling,
+		Flows:             flows,
+		TrackByOrigin:     trackByOrigin,
+		ConcurrencyTrack:  concurrencyTrack,
+		Downsample:        downsample,
+		MergeThreads:      mergeThreads,
+		SelfTime:          selfTime,
+		MaxEvents:         maxEvents,
+		CompleteEvents:    completeEvents,
+		KeepCategories:    keepCategories,
+		ExcludeFunctions:  excludeFunctions,
+		DropCategories:    dropCategories,
+		CollapseRecursion: collapseRecursion,
+		MaxDepth:          maxDepth,
+		Smooth:            smooth,
+		ExpandComplete:    expandComplete,
+		SampleInterval:    sampleInterval,
+		CountOnly:         count,
+		Jobs:              jobs,
+		Streaming:         streaming,
+		Force:             force,
+		Warn: func(err error) {
+			if quiet {
+				suppressed++
+				return
+			}
+			fmt.Fprintln(os.Stderr, err)
+		},
+	}
+	c, err := chrome2spall.NewConverter(w, opts)
+	if err != nil {
+		return err
+	}
+
+	if len(paths) == 0 {
+		paths = []string{""}
+	}
+	var converted []string
+	add := func(path string, convert func(io.Reader) error) error {
+		openedInput = nil
+		input, err := openInput(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not open file: %v\n", err)
+			return nil
+		}
+
+		name := path
+		if name == "" {
+			name = "stdin"
+		}
+		converted = append(converted, name)
+
+		err = convert(input)
+		input.Close()
+		keepManifestInput()
+		if errors.Is(err, chrome2spall.ErrNotATrace) {
+			return fmt.Errorf("%s: %w (use --force to convert it anyway)", name, err)
+		} else if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		return nil
+	}
+	for _, path := range paths {
+		if path == "-" {
+			path = ""
+		}
+		if info, err := os.Stat(path); path != "" && err == nil && info.IsDir() {
+			profiles, err := nodeProfiles(path)
+			if err != nil {
+				return err
+			}
+			for _, p := range profiles {
+				err := add(p.path, func(r io.Reader) error {
+					return c.AddCPUProfile(r, p.pid, p.tid)
+				})
+				if err != nil {
+					return err
+				}
+			}
+			continue
+		}
+
+		if err := add(path, c.Add); err != nil {
+			return err
+		}
+	}
+
+	stats, err := c.Close()
+	if suppressed > 0 {
+		fmt.Fprintf(os.Stderr, "Suppressed %d warnings (run without --quiet to see them)\n", suppressed)
+	}
+	if stats.EventLimitReached && !quiet {
+		if stats.InputUnread {
+			fmt.Fprintf(os.Stderr, "Stopped at --max-events %d, having covered %.3fms of the trace, and read no further\n", maxEvents, (stats.LastTime-stats.FirstTime)/1000)
+		} else {
+			fmt.Fprintf(os.Stderr, "Stopped at --max-events %d, having covered %.3fms of the trace's %.3fms\n", maxEvents, (stats.LastTime-stats.FirstTime)/1000, (stats.InputLastTime-stats.InputFirstTime)/1000)
+		}
+	}
+	if count {
+		stats.PrintProcesses(os.Stdout)
+	}
+	if showStats {
+		fmt.Fprintf(os.Stderr, "chrome2spall version:   %s\n", version)
+		stats.Print(os.Stderr, converted)
+	}
+	if err == nil && manifestOut != "" {
+		if err := writeManifest(manifestOut, stats); err != nil {
+			return fmt.Errorf("Could not write manifest: %v", err)
+		}
+	}
+	return err
 }
 
-type CallFrame struct {
-	CodeType     string `json:"codeType"`
-	FunctionName string `json:"functionName"`
-	LineNumber   int    `json:"lineNumber"`
-	ColumnNumber int    `json:"columnNumber"`
-	ScriptID     int    `json:"scriptId"`
-	URL          string `json:"url"`
+// nodeProfile is one of the .cpuprofile files written by node --cpu-prof.
+type nodeProfile struct {
+	path     string
+	pid, tid int
 }
 
-func must1[T any](v T, err error) T {
+// nodeProfileName matches the names node --cpu-prof gives its profiles:
+// CPU.<date>.<time>.<pid>.<thread>.<sequence>.cpuprofile
+var nodeProfileName = regexp.MustCompile(`^CPU\.\d+\.\d+\.(\d+)\.(\d+)\.\d+\.cpuprofile$`)
+
+// nodeProfiles finds the profiles in a directory written by node --cpu-prof,
+// with the process and thread that each came from, so that all of a run's
+// workers can be converted into one capture.
+func nodeProfiles(dir string) ([]nodeProfile, error) {
+	entries, err := os.ReadDir(dir)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	return v
+
+	var profiles []nodeProfile
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".cpuprofile") {
+			continue
+		}
+		m := nodeProfileName.FindStringSubmatch(entry.Name())
+		if m == nil {
+			fmt.Fprintf(os.Stderr, "Skipping %s: not named like a profile from node --cpu-prof\n", filepath.Join(dir, entry.Name()))
+			continue
+		}
+		pid, _ := strconv.Atoi(m[1])
+		tid, _ := strconv.Atoi(m[2])
+		profiles = append(profiles, nodeProfile{filepath.Join(dir, entry.Name()), pid, tid})
+	}
+	if len(profiles) == 0 {
+		return nil, fmt.Errorf("%s: no profiles from node --cpu-prof in this directory", dir)
+	}
+	return profiles, nil
 }
 
-func min[T constraints.Ordered](a, b T) T {
-	if a < b {
-		return a
-	} else {
-		return b
+// parseRemap parses old:new pairs of ids, as given to --remap.
+func parseRemap(flag string, pairs []string) (map[int]int, error) {
+	if len(pairs) == 0 {
+		return nil, nil
+	}
+	remap := make(map[int]int, len(pairs))
+	for _, pair := range pairs {
+		from, to, ok := strings.Cut(pair, ":")
+		fromID, ferr := strconv.Atoi(from)
+		toID, terr := strconv.Atoi(to)
+		if !ok || ferr != nil || terr != nil {
+			return nil, fmt.Errorf("invalid %s pair %q (expected old:new)", flag, pair)
+		}
+		remap[fromID] = toID
 	}
+	return remap, nil
 }
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestMain runs the command itself, instead of the tests, when a test has
+// started this binary through runMain.
+func TestMain(m *testing.M) {
+	if os.Getenv("CHROME2SPALL_RUN_MAIN") == "1" {
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// runMain runs chrome2spall with the given arguments and stdin, in dir, and
+// returns what it wrote to stdout, failing the test if it fails.
+func runMain(t *testing.T, dir string, stdin io.Reader, args ...string) []byte {
+	t.Helper()
+	stdout, stderr, err := tryMain(dir, stdin, args...)
+	if err != nil {
+		t.Fatalf("chrome2spall %q: %v\n%s", args, err, stderr)
+	}
+	return stdout
+}
+
+// tryMain runs chrome2spall like runMain, but leaves it to the caller to
+// decide whether it failed.
+func tryMain(dir string, stdin io.Reader, args ...string) (stdout, stderr []byte, err error) {
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Env = append(os.Environ(), "CHROME2SPALL_RUN_MAIN=1")
+	cmd.Dir = dir
+	cmd.Stdin = stdin
+	var outBuf, errBuf bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &outBuf, &errBuf
+	err = cmd.Run()
+	return outBuf.Bytes(), errBuf.Bytes(), err
+}
+
+// readTrace reads one of the library's test traces.
+func readTrace(t *testing.T, name string) []byte {
+	t.Helper()
+	trace, err := os.ReadFile(filepath.Join("pkg", "chrome2spall", "testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return trace
+}
+
+func TestInputArgs(t *testing.T) {
+	trace := readTrace(t, "nested.json")
+	dir := t.TempDir()
+	for _, name := range []string{"trace.json", "-dash.json"} {
+		if err := os.WriteFile(filepath.Join(dir, name), trace, 0o666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := runMain(t, dir, nil, "trace.json")
+	if !bytes.Contains(want, []byte(`"ph":"B"`)) {
+		t.Fatalf("converting trace.json gave no frames:\n%s", want)
+	}
+
+	tests := []struct {
+		name  string
+		args  []string
+		stdin []byte
+	}{
+		{"no args", nil, trace},
+		{"dash", []string{"-"}, trace},
+		{"flags only", []string{"--format", "json"}, trace},
+		{"double dash", []string{"--", "-dash.json"}, nil},
+		{"flags then double dash", []string{"--format", "json", "--", "-dash.json"}, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			out := runMain(t, dir, bytes.NewReader(test.stdin), test.args...)
+			if !bytes.Equal(out, want) {
+				t.Errorf("got:\n%s\nwant:\n%s", out, want)
+			}
+		})
+	}
+
+	t.Run("output file", func(t *testing.T) {
+		runMain(t, dir, bytes.NewReader(trace), "-o", "out.json")
+		out, err := os.ReadFile(filepath.Join(dir, "out.json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(out, want) {
+			t.Errorf("got:\n%s\nwant:\n%s", out, want)
+		}
+	})
+}
+
+func TestNotATrace(t *testing.T) {
+	text := strings.Repeat("just some text\n", 200)
+	_, stderr, err := tryMain(t.TempDir(), strings.NewReader(text))
+	if err == nil {
+		t.Fatal("converting text succeeded")
+	}
+	for _, want := range []string{"does not look like a Chrome trace", "--force"} {
+		if !strings.Contains(string(stderr), want) {
+			t.Errorf("error %q doesn't mention %q", stderr, want)
+		}
+	}
+
+	if _, stderr, err := tryMain(t.TempDir(), strings.NewReader(text), "--force", "--quiet"); err != nil {
+		t.Errorf("converting text with --force failed: %v\n%s", err, stderr)
+	}
+}
+
+// TestGzipInput converts a gzipped trace in each of the ways it can be
+// recognized, and expects the same output as for the plain trace.
+func TestGzipInput(t *testing.T) {
+	trace := readTrace(t, "nested.json")
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write(trace)
+	zw.Close()
+
+	dir := t.TempDir()
+	for name, data := range map[string][]byte{
+		"trace.json":    trace,
+		"trace.json.gz": gz.Bytes(),
+		"trace.gzipped": gz.Bytes(),
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0o666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := runMain(t, dir, nil, "trace.json")
+
+	tests := []struct {
+		name  string
+		args  []string
+		stdin []byte
+	}{
+		{"by name", []string{"trace.json.gz"}, nil},
+		{"by contents", []string{"trace.gzipped"}, nil},
+		{"stdin", nil, gz.Bytes()},
+		{"input format", []string{"--input-format", "ndjson+gz", "trace.gzipped"}, nil},
+		{"plain stdin", nil, trace},
+		{"plain input format", []string{"--input-format", "ndjson"}, trace},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			out := runMain(t, dir, bytes.NewReader(test.stdin), test.args...)
+			if !bytes.Equal(out, want) {
+				t.Errorf("got:\n%s\nwant:\n%s", out, want)
+			}
+		})
+	}
+}
+
+// TestPipeInput feeds a trace through a pipe a piece at a time, as stdin and
+// by its path, and expects the conversion to finish once the pipe is closed.
+// A pipe's end really is the end, so --follow doesn't wait for more.
+func TestPipeInput(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("no /dev/fd")
+	}
+	trace := readTrace(t, "nested.json")
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "trace.json"), trace, 0o666); err != nil {
+		t.Fatal(err)
+	}
+	want := runMain(t, dir, nil, "trace.json")
+
+	tests := []struct {
+		name  string
+		stdin bool
+		args  []string
+	}{
+		{"stdin", true, nil},
+		{"path", false, []string{"/dev/fd/3"}},
+		{"follow", false, []string{"--follow", "/dev/fd/3"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r, w, err := os.Pipe()
+			if err != nil {
+				t.Fatal(err)
+			}
+			cmd := exec.Command(os.Args[0], test.args...)
+			cmd.Env = append(os.Environ(), "CHROME2SPALL_RUN_MAIN=1")
+			if test.stdin {
+				cmd.Stdin = r
+			} else {
+				cmd.ExtraFiles = []*os.File{r}
+			}
+			var stdout, stderr bytes.Buffer
+			cmd.Stdout, cmd.Stderr = &stdout, &stderr
+			if err := cmd.Start(); err != nil {
+				t.Fatal(err)
+			}
+			r.Close()
+
+			for rest := trace; len(rest) > 0; {
+				n := 200
+				if n > len(rest) {
+					n = len(rest)
+				}
+				if _, err := w.Write(rest[:n]); err != nil {
+					t.Fatal(err)
+				}
+				rest = rest[n:]
+				time.Sleep(time.Millisecond)
+			}
+			w.Close()
+
+			done := make(chan error, 1)
+			go func() { done <- cmd.Wait() }()
+			select {
+			case err := <-done:
+				if err != nil {
+					t.Fatalf("%v\n%s", err, stderr.Bytes())
+				}
+			case <-time.After(10 * time.Second):
+				cmd.Process.Kill()
+				t.Fatal("still running after the pipe was closed")
+			}
+			if !bytes.Equal(stdout.Bytes(), want) {
+				t.Errorf("got:\n%s\nwant:\n%s", stdout.Bytes(), want)
+			}
+		})
+	}
+}
+
+// TestValidateOutputFormat expects --validate-output to turn down a format it
+// can't read back before converting anything.
+func TestValidateOutputFormat(t *testing.T) {
+	dir := t.TempDir()
+	_, stderr, err := tryMain(dir, bytes.NewReader(readTrace(t, "nested.json")), "--validate-output", "--format", "perfetto", "-o", "out.pftrace")
+	if err == nil {
+		t.Fatal("--validate-output with perfetto output succeeded")
+	}
+	if !strings.Contains(string(stderr), "--validate-output") || strings.Contains(string(stderr), "malformed") {
+		t.Errorf("error %q doesn't blame --validate-output", stderr)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "out.pftrace")); !os.IsNotExist(err) {
+		t.Errorf("output was written anyway (%v)", err)
+	}
+
+	runMain(t, dir, bytes.NewReader(readTrace(t, "nested.json")), "--validate-output", "--format", "binary", "-o", "out.spall")
+}
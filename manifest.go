@@ -0,0 +1,138 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"hash"
+	"io"
+	"os"
+	"strconv"
+
+	"github.com/bvisness/chrome2spall/pkg/chrome2spall"
+	"github.com/spf13/pflag"
+)
+
+// manifest is what --manifest writes: a description of a conversion, to keep
+// alongside its output. Times are in microseconds, as in the output.
+type manifest struct {
+	Version string            `json:"version"`
+	Flags   map[string]string `json:"flags"` // the ones that were set
+	Output  string            `json:"output"`
+	Format  string            `json:"format"`
+
+	Inputs    []*manifestInput           `json:"inputs"`
+	Samples   int                        `json:"samples"`
+	FirstTime *float64                   `json:"firstTime,omitempty"`
+	LastTime  *float64                   `json:"lastTime,omitempty"`
+	Processes map[string]manifestProcess `json:"processes"`
+}
+
+// manifestInput describes one input, as it was read: the size and hash are
+// of the bytes before they were decompressed.
+type manifestInput struct {
+	Name      string `json:"name"`
+	Size      int64  `json:"size"`
+	SHA256    string `json:"sha256"`
+	PidOffset int    `json:"pidOffset"` // -1 if the pids were left alone
+
+	hash hash.Hash
+}
+
+type manifestProcess struct {
+	Name     string            `json:"name,omitempty"`
+	Main     bool              `json:"main,omitempty"`
+	Profiles int               `json:"profiles"`
+	Samples  int               `json:"samples"`
+	Threads  map[string]string `json:"threads,omitempty"` // tid to name
+}
+
+// manifestInputs collects the inputs that have been converted, for
+// --manifest, in the order they were given to the converter, so that they
+// line up with Stats.PidOffsets. openedInput is the one that was last opened,
+// until keepManifestInput adds it.
+var (
+	manifestInputs []*manifestInput
+	openedInput    *manifestInput
+)
+
+// hashingReader counts and hashes an input as it's read.
+type hashingReader struct {
+	io.ReadCloser
+	input *manifestInput
+}
+
+func newHashingReader(r io.ReadCloser, name string) *hashingReader {
+	input := &manifestInput{Name: name, hash: sha256.New()}
+	openedInput = input
+	return &hashingReader{ReadCloser: r, input: input}
+}
+
+// keepManifestInput adds the input that was last opened to the manifest,
+// once it's been given to the converter. Inputs that couldn't be opened, or
+// turned out not to be gzipped after all, never get this far.
+func keepManifestInput() {
+	if openedInput != nil {
+		manifestInputs = append(manifestInputs, openedInput)
+		openedInput = nil
+	}
+}
+
+func (hr *hashingReader) Read(p []byte) (int, error) {
+	n, err := hr.ReadCloser.Read(p)
+	hr.input.Size += int64(n)
+	hr.input.hash.Write(p[:n])
+	return n, err
+}
+
+// writeManifest writes the --manifest file for a finished conversion.
+func writeManifest(path string, stats chrome2spall.Stats) error {
+	m := manifest{
+		Version:   version,
+		Flags:     make(map[string]string),
+		Output:    outputPath,
+		Format:    format,
+		Inputs:    manifestInputs,
+		Samples:   stats.Samples,
+		Processes: make(map[string]manifestProcess),
+	}
+	rootCmd.Flags().Visit(func(f *pflag.Flag) {
+		if f.Name != "manifest" {
+			m.Flags[f.Name] = f.Value.String()
+		}
+	})
+	if splitDir != "" {
+		m.Output = splitDir
+	} else if outputPath == "" {
+		m.Output = "stdout"
+	}
+	for i, input := range m.Inputs {
+		input.SHA256 = hex.EncodeToString(input.hash.Sum(nil))
+		input.PidOffset = i * chrome2spall.MultiFilePidOffset
+		if i < len(stats.PidOffsets) {
+			input.PidOffset = stats.PidOffsets[i]
+		}
+	}
+	if stats.BeginEvents+stats.EndEvents > 0 {
+		m.FirstTime, m.LastTime = &stats.FirstTime, &stats.LastTime
+	}
+	for pid, p := range stats.Processes {
+		mp := manifestProcess{
+			Name:     p.Name,
+			Main:     p.Main,
+			Profiles: p.Profiles,
+			Samples:  p.Samples,
+			Threads:  make(map[string]string),
+		}
+		for tid, name := range p.ThreadNames {
+			mp.Threads[strconv.Itoa(tid)] = name
+		}
+		m.Processes[strconv.Itoa(pid)] = mp
+	}
+
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0o666)
+}
@@ -0,0 +1,491 @@
+// Package chrome2spall converts Chrome's performance profiles into spall
+// files.
+package chrome2spall
+
+import (
+	"fmt"
+	"io"
+	"regexp"
+	"text/template"
+	"time"
+)
+
+// Options controls a conversion. The zero value converts everything into
+// spall's JSON format.
+type Options struct {
+	// Format is the output format: "json" (the default) for Chrome trace
+	// events, "binary" for spall's native format, or "perfetto" for a
+	// Perfetto protobuf trace.
+	//
+	// Spall reads each thread's binary events in the order they're written,
+	// and can't sort them the way it does JSON. So unless Streaming is set,
+	// binary output is held until the end, as with Jobs, and merged by time.
+	// With Streaming, events are written as they come, and any that would go
+	// back in time on their thread are moved up to the last one written.
+	Format string
+
+	// SplitOutput, if not nil, is called to open a separate output for each
+	// process, the first time it has something to write. The Converter's
+	// own writer is then left unused. Every output that was opened is
+	// closed by Close.
+	SplitOutput func(pid int) (io.WriteCloser, error)
+
+	// Pretty indents each event in the JSON output to make it easier to
+	// read.
+	Pretty bool
+
+	// CompleteEvents writes each frame in the JSON output as a single
+	// complete (X) event with a duration, instead of a begin and an end,
+	// which makes the output about half the size.
+	CompleteEvents bool
+
+	// Wrap writes the JSON output as a strictly valid document, with the
+	// events in a traceEvents array, instead of the lenient stream of
+	// comma-terminated events that spall accepts. Some other tools insist
+	// on it.
+	Wrap bool
+
+	// DisplayUnit is the time unit, "ms" or "ns", that wrapped output tells
+	// viewers to show timestamps in. It defaults to "ms". Unwrapped output
+	// has nowhere to say, so it can only be changed along with Wrap.
+	DisplayUnit string
+
+	// Append continues an output that was written before, instead of
+	// starting a new one, by leaving out the spall header or the opening
+	// of the JSON array. A JSON output's closing bracket has to be removed
+	// before w is written to. The earlier output must be in the same format
+	// and have been written with the same Wrap. (Perfetto traces can be
+	// appended to as they are.)
+	Append bool
+
+	// InputFormat is the layout of the input: "ndjson" for Chrome's streaming
+	// format of one event per line, "array" for a JSON array of events laid
+	// out any which way, "object" for a JSON object with a traceEvents
+	// array, or "cpuprofile" for a standalone .cpuprofile. By default, or
+	// with "auto", it's worked out from the input.
+	InputFormat string
+
+	// TimestampUnit is the unit of the input's timestamps: "us" (the
+	// default, and what Chrome uses), "ns", or "ms". Every output format
+	// uses microseconds.
+	TimestampUnit string
+
+	// Pids and Tids, if not empty, limit the conversion to those processes
+	// and threads.
+	Pids, Tids []int
+
+	// MainOnly limits the conversion to the process rendering the page's
+	// main frame, as reported by the TracingStartedInBrowser event that
+	// Chrome records at the start of a trace.
+	MainOnly bool
+
+	// Start and End drop everything outside a window of time, measured
+	// from the start of the trace. An End of zero means no limit. The window
+	// is applied as the input is read, so the start of the trace is the
+	// timestamp of its first event, other than metadata, in the order they
+	// appear (or a .cpuprofile's start time), not the earliest one. Chrome
+	// writes events roughly in time order, but one that's out of order,
+	// from before the first, falls outside any window.
+	Start, End time.Duration
+
+	// SinceMarker and UntilMarker limit the conversion to the time between
+	// two markers, such as a console.timeStamp(label), by their names, in
+	// place of Start and End. If a name appears more than once, the window
+	// goes from the first SinceMarker to the first UntilMarker after it. A
+	// missing marker is warned about, and leaves that end of the window
+	// open. The markers could be anywhere in the input, so the whole output
+	// is held until the end, and Streaming is not allowed.
+	SinceMarker, UntilMarker string
+
+	// RebaseZero shifts the whole output so that its earliest timestamp is
+	// zero. That isn't known until the end, so the output is held until
+	// then, unless Streaming is set. Then the first timestamp written is
+	// taken as zero, and anything earlier that turns up later, like a
+	// marker read after the frames around it, is moved up to zero.
+	RebaseZero bool
+
+	// RemapPids and RemapTids replace pids and tids in the output, to keep
+	// them from colliding with other data. They apply after the pid offset
+	// for multiple traces, and after filtering by Pids and Tids. Anything
+	// not in the maps is left as it is.
+	RemapPids, RemapTids map[int]int
+
+	// MinDuration drops frames shorter than this.
+	MinDuration time.Duration
+
+	// Category is the category (cat) of emitted frames, "function" by
+	// default. OriginPlaceholder is replaced by the frame's script origin.
+	Category string
+
+	// TagKind adds the kind of code each frame ran to its category, after a
+	// comma: "js", "native", "gc", or "idle".
+	TagKind bool
+
+	// ColorBy can be set to "origin" to color each frame by the origin of its
+	// script, using the trace event format's cname field. If AppPrefix is
+	// also set, frames from scripts whose URL starts with it are colored as
+	// app code, and all the rest as vendor code. Spall's binary format and
+	// Perfetto have nowhere to put colors, so this only affects JSON.
+	ColorBy   string
+	AppPrefix string
+
+	// NameTemplate, if set, is a text/template that names each frame in
+	// place of the usual function names. It's executed with a
+	// FrameNameData, like "{{.FunctionName}} ({{.URL}}:{{.Line}})". If it
+	// fails on a frame, that frame and the rest get their usual names.
+	NameTemplate string
+
+	// WithURL appends the source URL and line to every function name.
+	WithURL bool
+
+	// EmitArgs attaches each frame's source location (url, line, col, and
+	// scriptId) to its begin event as args.
+	EmitArgs bool
+
+	// SelfTime attaches each frame's self time, the time it spent on top
+	// of the stack rather than in its children, to its end event as a
+	// SelfTimeArgs. Viewers show it along with the begin's args. With
+	// CompleteEvents, it goes in the args of the one event. Spall's binary
+	// format has no args, so this doesn't affect it.
+	SelfTime bool
+
+	// KeepProgram emits V8's (program) pseudo-frames instead of treating
+	// them as empty stacks.
+	KeepProgram bool
+
+	// SkipNative leaves out native frames for engine internals, other than
+	// garbage collection. Any JS they call appears under the nearest JS
+	// frame instead.
+	SkipNative bool
+
+	// ExcludeFunctions leaves out the frames whose names (as they would be
+	// written) match any of these regular expressions, like the frames of
+	// a framework's scheduler. As with SkipNative, whatever they call
+	// appears under the nearest frame that's kept.
+	ExcludeFunctions []string
+
+	// MaxDepth, if not zero, leaves out frames more than this many levels
+	// deep.
+	MaxDepth int
+
+	// Smooth, if not zero, ignores a change of stack when the old stack
+	// comes back within this many samples. At high sampling rates this
+	// hides a lot of one-sample flickers, at the cost of a little accuracy:
+	// whatever really happened in those samples is lost.
+	Smooth int
+
+	// TrackByOrigin puts each frame on a track (tid) of its own for the
+	// origin of its script, so that the time spent in each site or library
+	// can be seen side by side. Frames without a script, like native code
+	// and garbage collection, stay on the thread that was sampled. Frames
+	// only nest within their own track, so a call from one origin into
+	// another shows up as two unrelated frames on different tracks.
+	TrackByOrigin bool
+
+	// MergeThreads puts all of each process's threads on a single track,
+	// with the tid that each frame came from added to its name. Frames from
+	// threads that ran at the same time are interleaved by time; where they
+	// overlap without nesting, the frames in the way are split in two, so
+	// that everything stays balanced. Everything is held until the end to
+	// be put in order, so Streaming is not allowed.
+	MergeThreads bool
+
+	// ConcurrencyTrack adds a track, in a process of its own, showing how
+	// many threads were busy (running anything but idle) over time. It's
+	// sampled every millisecond, once everything else has been converted.
+	// Every change in how many threads are busy is held until then, so
+	// Streaming is not allowed.
+	ConcurrencyTrack bool
+
+	// Downsample, if more than 1, keeps only every Nth sample of each
+	// profile, to make enormous profiles small enough to open. The stack
+	// carries on from one kept sample to the next, so anything that came
+	// and went in between is lost.
+	Downsample int
+
+	// MaxEvents, if not zero, stops writing frames once this many begin and
+	// end events have been written, for a quick look at the start of a big
+	// trace. Frames still open then are ended where they were cut off, so
+	// the output is still balanced. Stats.EventLimitReached says whether
+	// anything was cut. Frames go out one profile at a time unless they're
+	// merged by time, with Jobs or binary output (without Streaming), so
+	// with several profiles, only those truly cut the trace off at a point
+	// in time. Otherwise, the rest of the input isn't even read, which
+	// Stats.InputUnread says.
+	MaxEvents int
+
+	// CollapseRecursion keeps a single frame open when a function calls
+	// itself directly, instead of nesting a new frame for each call.
+	CollapseRecursion bool
+
+	// GCAsSibling ends the JS frames that were running when a garbage
+	// collection starts, and shows the collection on its own, the way V8's
+	// call tree does. By default, collections are nested under the JS that
+	// triggered them.
+	GCAsSibling bool
+
+	// KeepCategories, if not empty, passes through only the events that
+	// aren't converted if they have one of these categories, and
+	// DropCategories leaves out those that have one of its categories. The
+	// CPU profile itself is always converted either way.
+	KeepCategories []string
+	DropCategories []string
+
+	// Flows converts flow and async events, which connect a task to where
+	// it was posted from, into instant markers labeled with their ids, so
+	// that each step of a chain can be found in spall. By default they're
+	// passed through, and spall ignores them.
+	Flows bool
+
+	// ShowIdle shows idle time as explicit (idle) frames instead of gaps.
+	ShowIdle bool
+
+	// ExpandComplete converts complete (X) events, which are passed through
+	// as-is by default, into begin and end events.
+	ExpandComplete bool
+
+	// SampleInterval can be set to "auto" to let the last sample of a
+	// profile run for one (median) sampling interval, so that frames that
+	// only appear in it have a width.
+	SampleInterval string
+
+	// CountOnly skips the conversion entirely, and only collects the
+	// Processes in the Stats. Nothing is written to the output.
+	CountOnly bool
+
+	// Jobs is the number of profiles to convert in parallel. Zero means to
+	// convert everything serially, streaming out events as they're ready.
+	// Otherwise, each profile's events are held until the end, and then
+	// merged by time.
+	Jobs int
+
+	// Streaming guarantees that memory use doesn't grow with the size of
+	// the input: beyond each profile's call tree and open frames, only one
+	// event is held at a time, whichever trace layout the input uses.
+	// ProfileChunks that arrive before their Profile are converted as if the
+	// Profile never came, instead of waiting for it, and Jobs is not
+	// allowed. (A standalone .cpuprofile is one big object, so it's always
+	// read whole.)
+	Streaming bool
+
+	// Force converts the input even if it doesn't look like a Chrome trace.
+	Force bool
+
+	// Warn, if not nil, is called with each problem that the conversion
+	// carried on despite, like events that couldn't be read (a *ParseError)
+	// or profiles that were missing pieces (a *ProcessError). See
+	// ErrNoProfileForPid and the other errors for the rest.
+	Warn func(err error)
+}
+
+// Convert converts a single trace from r and writes it to w.
+func Convert(r io.Reader, w io.Writer, opts Options) (Stats, error) {
+	c, err := NewConverter(w, opts)
+	if err != nil {
+		return Stats{}, err
+	}
+
+	err = c.Add(r)
+	stats, cerr := c.Close()
+	if err == nil {
+		err = cerr
+	}
+	return stats, err
+}
+
+// NewConverter creates a Converter that writes to w.
+func NewConverter(w io.Writer, opts Options) (*Converter, error) {
+	if opts.Format == "" {
+		opts.Format = "json"
+	}
+	if opts.Category == "" {
+		opts.Category = "function"
+	}
+	switch opts.TimestampUnit {
+	case "":
+		opts.TimestampUnit = "us"
+	case "us", "ns", "ms":
+	default:
+		return nil, fmt.Errorf("unknown timestamp unit %q (expected us, ns, or ms)", opts.TimestampUnit)
+	}
+	switch opts.DisplayUnit {
+	case "":
+		opts.DisplayUnit = "ms"
+	case "ms", "ns":
+	default:
+		return nil, fmt.Errorf("unknown display unit %q (expected ms or ns)", opts.DisplayUnit)
+	}
+	if opts.DisplayUnit != "ms" && !opts.Wrap {
+		return nil, fmt.Errorf("the display unit can only be changed in wrapped output")
+	}
+	if opts.ColorBy != "" && opts.ColorBy != colorByOrigin {
+		return nil, fmt.Errorf("unknown color mode %q (expected origin)", opts.ColorBy)
+	}
+	if opts.Smooth < 0 {
+		return nil, fmt.Errorf("invalid smoothing %d", opts.Smooth)
+	}
+	if opts.Downsample < 0 {
+		return nil, fmt.Errorf("invalid downsampling %d", opts.Downsample)
+	}
+	if opts.MaxEvents < 0 {
+		return nil, fmt.Errorf("invalid max events %d", opts.MaxEvents)
+	}
+	if opts.MaxDepth < 0 {
+		return nil, fmt.Errorf("invalid max depth %d", opts.MaxDepth)
+	}
+	if (opts.SinceMarker != "" || opts.UntilMarker != "") && (opts.Start > 0 || opts.End > 0) {
+		return nil, fmt.Errorf("the time window can be set by markers or by time, but not both")
+	}
+	if opts.Streaming && (opts.SinceMarker != "" || opts.UntilMarker != "") {
+		return nil, fmt.Errorf("a time window set by markers holds every event until the end, so it can't be combined with streaming")
+	}
+	if opts.Streaming && opts.MergeThreads {
+		return nil, fmt.Errorf("merging threads holds every event until the end, so it can't be combined with streaming")
+	}
+	if opts.Streaming && opts.ConcurrencyTrack {
+		return nil, fmt.Errorf("the concurrency track holds every change in how many threads are busy until the end, so it can't be combined with streaming")
+	}
+	if opts.Streaming && opts.Jobs > 0 {
+		return nil, fmt.Errorf("converting in parallel holds every event until the end, so it can't be combined with streaming")
+	}
+	switch opts.InputFormat {
+	case "", "auto", "ndjson", "array", "object", "cpuprofile":
+	default:
+		return nil, fmt.Errorf("unknown input format %q (expected auto, ndjson, array, object, or cpuprofile)", opts.InputFormat)
+	}
+	if opts.SampleInterval != "" && opts.SampleInterval != "auto" {
+		return nil, fmt.Errorf("unknown sample interval %q (expected auto)", opts.SampleInterval)
+	}
+
+	var nameTemplate *template.Template
+	if opts.NameTemplate != "" {
+		var err error
+		nameTemplate, err = template.New("name").Parse(opts.NameTemplate)
+		if err != nil {
+			return nil, fmt.Errorf("invalid name template: %w", err)
+		}
+		// Most mistakes, like a misspelled field, only show up when the
+		// template runs, so try it once now rather than on every frame.
+		if err := nameTemplate.Execute(io.Discard, FrameNameData{}); err != nil {
+			return nil, fmt.Errorf("invalid name template: %w", err)
+		}
+	}
+
+	var excludeFunctions []*regexp.Regexp
+	for _, pattern := range opts.ExcludeFunctions {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid function pattern %q: %w", pattern, err)
+		}
+		excludeFunctions = append(excludeFunctions, re)
+	}
+
+	var out eventWriter = discardWriter{}
+	if !opts.CountOnly {
+		var err error
+		if opts.SplitOutput != nil {
+			out, err = newSplitWriter(opts)
+		} else {
+			out, err = newEventWriter(w, opts)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(opts.RemapPids) > 0 || len(opts.RemapTids) > 0 {
+		out = &remapFilter{eventWriter: out, pids: opts.RemapPids, tids: opts.RemapTids}
+	}
+	if opts.RebaseZero {
+		out = newRebaseFilter(out, opts.Streaming)
+	}
+	stats := &Stats{Pids: make(map[int]bool), Processes: make(map[int]*ProcessStats)}
+	out = &countingWriter{eventWriter: out, stats: stats}
+	if opts.MergeThreads {
+		out = newMergeThreadsFilter(out)
+	}
+	if opts.ConcurrencyTrack {
+		out = newConcurrencyWriter(out)
+	}
+	if opts.MaxEvents > 0 {
+		out = newMaxEventsFilter(out, opts.MaxEvents, stats)
+	}
+	if opts.MinDuration > 0 {
+		out = newMinDurationFilter(out, micros(opts.MinDuration))
+	}
+	var window *timeWindow
+	if opts.Start > 0 || opts.End > 0 {
+		window = &timeWindow{
+			startOffset: micros(opts.Start),
+			endOffset:   micros(opts.End),
+			hasEnd:      opts.End > 0,
+		}
+		out = newWindowFilter(out, window)
+	}
+	if opts.SinceMarker != "" || opts.UntilMarker != "" {
+		markerWindow := &timeWindow{}
+		out = newWindowFilter(out, markerWindow)
+		out = newMarkerFilter(out, markerWindow, opts.SinceMarker, opts.UntilMarker, opts.Warn)
+	}
+
+	c := &Converter{
+		opts:             opts,
+		out:              out,
+		profiles:         make(map[profileKey]*profileState),
+		processNames:     make(map[int]string),
+		threadNames:      make(map[threadID]string),
+		mainPids:         make(map[int]bool),
+		nameTemplate:     nameTemplate,
+		excludeFunctions: excludeFunctions,
+		pendingChunks:    make(map[profileKey][]pendingChunk),
+		window:           window,
+		stats:            stats,
+	}
+	if opts.Format == "binary" && !opts.Streaming && !opts.CountOnly {
+		// Spall reads each thread's events in the order they're written, so
+		// markers and expanded complete events have to be merged in among
+		// the profiles' frames.
+		c.traceEvents = &bufferWriter{}
+	}
+	if opts.Jobs > 0 {
+		c.startWorkers(opts.Jobs)
+	}
+	return c, nil
+}
+
+// micros converts a duration to the microseconds used by trace timestamps.
+func micros(d time.Duration) float64 {
+	return float64(d) / float64(time.Microsecond)
+}
+
+// Add converts a trace from r. Different traces may well reuse the same
+// pids, so the pids from the Nth trace added (counting from zero) are offset
+// by N*MultiFilePidOffset to keep their profiles from clobbering each other.
+func (c *Converter) Add(r io.Reader) error {
+	c.pidOffset = c.inputs * MultiFilePidOffset
+	c.inputs++
+	c.stats.PidOffsets = append(c.stats.PidOffsets, c.pidOffset)
+	return c.convert(r)
+}
+
+// AddCPUProfile converts a standalone .cpuprofile from r, like Add, but
+// attributes it to the given process and thread instead of made-up ones. The
+// pid is used as-is rather than offset, since it's presumably real.
+func (c *Converter) AddCPUProfile(r io.Reader, pid, tid int) error {
+	c.pidOffset = 0
+	c.inputs++
+	c.stats.PidOffsets = append(c.stats.PidOffsets, -1)
+	c.cpuProfileID = &threadID{pid, tid}
+	defer func() { c.cpuProfileID = nil }()
+	return c.convert(r)
+}
+
+// Close ends any frames that are still open and finishes the output. It
+// doesn't close the underlying writer.
+func (c *Converter) Close() (Stats, error) {
+	c.finish()
+	if err := c.out.close(); err != nil {
+		return *c.stats, fmt.Errorf("error writing output: %w", err)
+	}
+	return *c.stats, nil
+}
@@ -0,0 +1,40 @@
+package chrome2spall
+
+import (
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewConverterRejects(t *testing.T) {
+	tests := []struct {
+		name string
+		opts Options
+		err  string
+	}{
+		{"format", Options{Format: "svg"}, "unknown output format"},
+		{"timestamp unit", Options{TimestampUnit: "s"}, "unknown timestamp unit"},
+		{"display unit unwrapped", Options{DisplayUnit: "ns"}, "only be changed in wrapped output"},
+		{"input format", Options{InputFormat: "csv"}, "unknown input format"},
+		{"markers and times", Options{SinceMarker: "a", End: time.Second}, "markers or by time"},
+		{"markers and streaming", Options{UntilMarker: "a", Streaming: true}, "can't be combined with streaming"},
+		{"merged threads and streaming", Options{MergeThreads: true, Streaming: true}, "can't be combined with streaming"},
+		{"concurrency track and streaming", Options{ConcurrencyTrack: true, Streaming: true}, "can't be combined with streaming"},
+		{"jobs and streaming", Options{Jobs: 2, Streaming: true}, "can't be combined with streaming"},
+		{"name template", Options{NameTemplate: "{{.FunctionName"}, "invalid name template"},
+		{"name template field", Options{NameTemplate: "{{.Function}}"}, "invalid name template"},
+		{"exclude pattern", Options{ExcludeFunctions: []string{"("}}, "invalid function pattern"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := NewConverter(io.Discard, test.opts)
+			if err == nil {
+				t.Fatalf("no error, want one containing %q", test.err)
+			}
+			if !strings.Contains(err.Error(), test.err) {
+				t.Errorf("got error %q, want one containing %q", err, test.err)
+			}
+		})
+	}
+}
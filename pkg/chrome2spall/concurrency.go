@@ -0,0 +1,131 @@
+package chrome2spall
+
+import (
+	"fmt"
+	"math"
+
+	"golang.org/x/exp/slices"
+)
+
+// The concurrency track goes on a process and thread of its own, which no
+// Chrome trace uses.
+const (
+	concurrencyPid = 0
+	concurrencyTid = 0
+
+	// concurrencyInterval is how often, in microseconds, the number of busy
+	// threads is sampled. Sampling smooths over the few microseconds that
+	// frames are nudged by, which would otherwise show up as slivers.
+	concurrencyInterval = 1000
+)
+
+// concurrencyWriter watches every frame go by and, at the end, adds a track
+// showing how many threads were busy over time. A thread is busy while it
+// has any frame open, other than an (idle) one.
+//
+// Frames are written profile by profile, not in time order, so the moments
+// that threads start and stop being busy are kept until the end, when they
+// can be put in order.
+type concurrencyWriter struct {
+	eventWriter
+	tracks  map[threadID][]bool // for each open frame, whether it's busy
+	busy    map[threadID]int    // how many busy frames each thread has open
+	changes []concurrencyChange
+}
+
+type concurrencyChange struct {
+	Time  float64
+	Delta int // +1 when a thread becomes busy, -1 when it stops
+}
+
+func newConcurrencyWriter(next eventWriter) *concurrencyWriter {
+	return &concurrencyWriter{
+		eventWriter: next,
+		tracks:      make(map[threadID][]bool),
+		busy:        make(map[threadID]int),
+	}
+}
+
+func (cw *concurrencyWriter) writeBeginEvent(e Event) {
+	id := threadID{e.Pid, e.Tid}
+	busy := e.Name != "(idle)"
+	cw.tracks[id] = append(cw.tracks[id], busy)
+	if busy {
+		if cw.busy[id] == 0 {
+			cw.changes = append(cw.changes, concurrencyChange{e.Time, 1})
+		}
+		cw.busy[id]++
+	}
+	cw.eventWriter.writeBeginEvent(e)
+}
+
+func (cw *concurrencyWriter) writeEndEvent(e Event) {
+	id := threadID{e.Pid, e.Tid}
+	if stack := cw.tracks[id]; len(stack) > 0 {
+		busy := stack[len(stack)-1]
+		cw.tracks[id] = stack[:len(stack)-1]
+		if busy {
+			cw.busy[id]--
+			if cw.busy[id] == 0 {
+				cw.changes = append(cw.changes, concurrencyChange{e.Time, -1})
+			}
+		}
+	}
+	cw.eventWriter.writeEndEvent(e)
+}
+
+func (cw *concurrencyWriter) close() error {
+	cw.writeTrack()
+	return cw.eventWriter.close()
+}
+
+// writeTrack samples the number of busy threads every concurrencyInterval,
+// and writes a frame for each stretch where it stays the same.
+func (cw *concurrencyWriter) writeTrack() {
+	if len(cw.changes) == 0 {
+		return
+	}
+	slices.SortStableFunc(cw.changes, func(a, b concurrencyChange) bool {
+		return a.Time < b.Time
+	})
+	last := cw.changes[len(cw.changes)-1].Time
+
+	cw.eventWriter.writeProcessName(concurrencyPid, "Concurrency")
+	cw.eventWriter.writeThreadName(concurrencyPid, concurrencyTid, "Busy threads")
+
+	count, next := 0, 0
+	spanCount, spanStart := 0, 0.0
+	endSpan := func(t float64) {
+		if spanCount > 0 {
+			cw.eventWriter.writeBeginEvent(Event{
+				Category: "concurrency",
+				Name:     fmt.Sprintf("%d busy", spanCount),
+				Type:     "B",
+				Pid:      concurrencyPid,
+				Tid:      concurrencyTid,
+				Time:     spanStart,
+			})
+			cw.eventWriter.writeEndEvent(Event{
+				Category: "concurrency",
+				Type:     "E",
+				Pid:      concurrencyPid,
+				Tid:      concurrencyTid,
+				Time:     t,
+			})
+		}
+	}
+	start := cw.changes[0].Time
+	steps := int(math.Ceil((last - start) / concurrencyInterval))
+	for i := 0; i <= steps; i++ {
+		t := start + float64(i)*concurrencyInterval
+		for next < len(cw.changes) && cw.changes[next].Time <= t {
+			count += cw.changes[next].Delta
+			next++
+		}
+		if count != spanCount {
+			endSpan(t)
+			spanCount, spanStart = count, t
+		}
+	}
+	endSpan(start + float64(steps)*concurrencyInterval)
+}
@@ -0,0 +1,1993 @@
+package chrome2spall
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"math"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/template"
+
+	"golang.org/x/exp/constraints"
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
+)
+
+// MultiFilePidOffset separates the pids of each input when converting
+// several at once. It's larger than any pid Linux will hand out.
+const MultiFilePidOffset = 10_000_000
+
+// A Converter merges any number of traces into a single output.
+type Converter struct {
+	opts Options
+
+	out      eventWriter
+	profiles map[profileKey]*profileState
+
+	processNames map[int]string
+	threadNames  map[threadID]string
+
+	// mainPids holds the processes that rendered a top-level frame, going
+	// by TracingStartedInBrowser, and foundMain is set once the current
+	// input has told us about one.
+	mainPids  map[int]bool
+	foundMain bool
+
+	// pendingChunks holds ProfileChunks, by profile, that arrived before
+	// their Profile event.
+	pendingChunks map[profileKey][]pendingChunk
+
+	// nameTemplate is Options.NameTemplate, compiled, or nil.
+	// nameTemplateFailed is set once it has failed on a frame, after which
+	// frames get their usual names.
+	nameTemplate       *template.Template
+	nameTemplateFailed atomic.Bool
+
+	// excludeFunctions is Options.ExcludeFunctions, compiled.
+	excludeFunctions []*regexp.Regexp
+
+	// window is the time range we're keeping, or nil to keep everything.
+	window *timeWindow
+
+	stats *Stats
+
+	// allProfiles holds every profile we've seen, including the ones that
+	// were replaced when their process restarted the profiler.
+	allProfiles []*profileState
+
+	// workers run the profiles' conversion when converting in parallel,
+	// and buffers hold their events until the end.
+	workers []chan func()
+	wg      sync.WaitGroup
+	buffers []*bufferWriter
+
+	// traceEvents, if not nil, holds the markers and frames converted from
+	// the trace's own events until the end, to be merged by time with the
+	// profiles' events, for the binary format's sake.
+	traceEvents *bufferWriter
+
+	warnMu sync.Mutex
+
+	// inputs counts the traces added so far, and pidOffset is added to the
+	// pid of every event in the current one.
+	inputs    int
+	pidOffset int
+
+	// cpuProfileID, if not nil, is the process and thread that the current
+	// input's standalone .cpuprofile came from.
+	cpuProfileID *threadID
+
+	// validated is set once the current input has shown us something
+	// shaped like a trace event, and checked counts the lines we looked at
+	// before that happened.
+	validated bool
+	checked   int
+
+	// line is the line of the current input that's being converted, or
+	// offset how far into it we are, for ParseErrors.
+	line   int
+	offset int64
+}
+
+// validationLines is how many lines of input we look through for a trace
+// event before deciding that we were given something else entirely.
+const validationLines = 100
+
+// ErrNotATrace is returned for input that doesn't seem to contain any trace
+// events, unless Options.Force is set.
+var ErrNotATrace = errors.New("input does not look like a Chrome trace")
+
+// errEventLimitReached stops reading the input once Options.MaxEvents has
+// cut off the output, since nothing more could be written.
+var errEventLimitReached = errors.New("event limit reached")
+
+// stopReading reports whether the rest of the input can go unread.
+func (c *Converter) stopReading() error {
+	if c.stats.EventLimitReached {
+		return errEventLimitReached
+	}
+	return nil
+}
+
+// checkShape looks for a JSON object with the fields every trace event has,
+// so that random input fails loudly instead of being passed through into a
+// useless output file.
+func (c *Converter) checkShape(raw []byte) error {
+	if c.opts.Force || c.validated {
+		return nil
+	}
+
+	var shape struct {
+		Type json.RawMessage `json:"ph"`
+		Pid  json.RawMessage `json:"pid"`
+	}
+	if json.Unmarshal(raw, &shape) == nil && shape.Type != nil && shape.Pid != nil {
+		c.validated = true
+		return nil
+	}
+
+	c.checked++
+	if c.checked >= validationLines {
+		return ErrNotATrace
+	}
+	return nil
+}
+
+// warn reports a problem, like a single bad event, that the conversion
+// carries on regardless of.
+func (c *Converter) warn(err error) {
+	c.warnMu.Lock()
+	defer c.warnMu.Unlock()
+	if c.opts.Warn != nil {
+		c.opts.Warn(err)
+	}
+}
+
+// parseError describes an event at the current position in the input that
+// couldn't be read.
+func (c *Converter) parseError(data []byte, err error) *ParseError {
+	return &ParseError{Line: c.line, Offset: c.offset, Data: data, Err: err}
+}
+
+func (c *Converter) convert(r io.Reader) error {
+	c.validated, c.checked = false, 0
+	c.line, c.offset = 0, 0
+	c.foundMain = false
+
+	if c.stats.EventLimitReached {
+		// An earlier input used up Options.MaxEvents.
+		c.stats.InputUnread = true
+		return nil
+	}
+
+	var err error
+	br := bufio.NewReader(r)
+	skipBOM(br)
+	switch c.opts.InputFormat {
+	case "ndjson":
+		err = c.convertLines(br)
+	case "array":
+		err = c.convertArray(br)
+	case "object", "cpuprofile":
+		err = c.convertDocument(br)
+	default:
+		if isJSONDocument(br) {
+			err = c.convertDocument(br)
+		} else {
+			err = c.convertLines(br)
+		}
+	}
+	if errors.Is(err, errEventLimitReached) {
+		c.stats.InputUnread = true
+		err = nil
+	}
+	if err == nil && !c.opts.Force && !c.validated {
+		err = ErrNotATrace
+	}
+	c.flushPendingChunks()
+	if err == nil && c.opts.MainOnly && !c.foundMain {
+		c.warn(ErrNoMainFrame)
+	}
+	return err
+}
+
+// profileKey identifies a profile. Each thread that's sampled gets its own
+// profile, with its own numbering of nodes, and a single process can have
+// several. The ProfileChunks are posted by the profiler's own thread rather
+// than the one it samples, though, so the only thing that ties them to their
+// Profile is its id.
+type profileKey struct {
+	Pid int
+	ID  string
+}
+
+func (k profileKey) less(other profileKey) bool {
+	if k.Pid != other.Pid {
+		return k.Pid < other.Pid
+	}
+	return k.ID < other.ID
+}
+
+type pendingChunk struct {
+	Tid  int
+	Data ProfileChunkArgsData
+}
+
+// flushPendingChunks converts the chunks whose Profile never arrived. Without
+// the Profile we don't know when the profile started or which thread it
+// sampled, so assume it started at zero on the thread that posted the chunk.
+func (c *Converter) flushPendingChunks() {
+	keys := maps.Keys(c.pendingChunks)
+	slices.SortFunc(keys, profileKey.less)
+	for _, key := range keys {
+		chunks := c.pendingChunks[key]
+		c.warn(&ProcessError{key.Pid, fmt.Errorf("%w; assuming its profile started at 0", ErrNoProfileForPid)})
+		c.stats.OrphanChunks += len(chunks)
+
+		profile := c.newProfile(key, chunks[0].Tid, 0)
+		c.processPendingChunks(profile)
+	}
+}
+
+// processPendingChunks converts any chunks that were waiting for a profile to
+// show up.
+func (c *Converter) processPendingChunks(profile *profileState) {
+	chunks := c.pendingChunks[profile.key]
+	delete(c.pendingChunks, profile.key)
+	if !c.threadSelected(profile.Pid, profile.Tid) {
+		return
+	}
+	if c.opts.CountOnly {
+		for _, chunk := range chunks {
+			c.timeChunk(profile, chunk.Data)
+		}
+		return
+	}
+	c.run(profile, func() {
+		for _, chunk := range chunks {
+			c.processChunk(profile, chunk.Data)
+		}
+	})
+}
+
+// skipBOM skips the byte order mark that some Windows tools put at the
+// start of UTF-8 files, which would otherwise spoil the first event.
+func skipBOM(br *bufio.Reader) {
+	if b, err := br.Peek(3); err == nil && string(b) == "\xef\xbb\xbf" {
+		br.Discard(3)
+	}
+}
+
+// isJSONDocument reports whether the input is a single JSON object (like the
+// {"traceEvents":[...]} files saved by DevTools) rather than Chrome's
+// one-event-per-line array format.
+func isJSONDocument(br *bufio.Reader) bool {
+	for i := 1; ; i++ {
+		b, err := br.Peek(i)
+		if err != nil {
+			return false
+		}
+		switch b[i-1] {
+		case ' ', '\t', '\r', '\n':
+			continue
+		case '{':
+			return true
+		default:
+			return false
+		}
+	}
+}
+
+// convertLines handles Chrome's streaming format, where each line holds a
+// single event as an element of a (possibly unterminated) JSON array.
+//
+// When the input format is worked out automatically, an array that turns out
+// not to have one event per line, like a compact one on a single line or a
+// pretty-printed one, is handed over to convertArray instead, at the first
+// line that doesn't hold a whole event. That can only be the first event's
+// line; after that it's just a bad event. Input that doesn't start with a
+// bracket isn't an array at all, and its lines are left to fail as events.
+func (c *Converter) convertLines(br *bufio.Reader) error {
+	detecting := c.opts.InputFormat == "" || c.opts.InputFormat == "auto"
+	var head strings.Builder // what's been read, until an event is
+	parsed := false
+
+	// Chrome writes an entire ProfileChunk on one line, and those lines can
+	// easily exceed bufio.Scanner's token limit, so read whole lines with no
+	// length cap instead.
+	for done := false; !done; {
+		line, err := br.ReadString('\n')
+		c.line++
+		if detecting && !parsed {
+			head.WriteString(line)
+		}
+		if err != nil {
+			done = true
+			if err != io.EOF && !errors.Is(err, io.ErrUnexpectedEOF) {
+				return fmt.Errorf("error reading input: %w", err)
+			}
+			if line == "" {
+				break
+			}
+		}
+		// Trimming all the whitespace takes care of traces saved on Windows,
+		// with CRLF line endings, too.
+		line = strings.Trim(strings.TrimSpace(line), "[],")
+		if line == "" {
+			// The closing bracket, or a blank line.
+			continue
+		}
+		if detecting && !parsed && !json.Valid([]byte(line)) && strings.HasPrefix(strings.TrimSpace(head.String()), "[") {
+			c.line = 0
+			return c.convertArray(bufio.NewReader(io.MultiReader(strings.NewReader(head.String()), br)))
+		}
+		if err := c.checkShape([]byte(line)); err != nil {
+			return err
+		}
+
+		var event Event
+		err = json.Unmarshal([]byte(line), &event)
+		if err != nil {
+			c.warn(c.parseError([]byte(line), fmt.Errorf("error reading event: %w", err)))
+			c.stats.ParseErrors++
+			if done && parsed {
+				// The last line was cut off partway through. (If no line
+				// before it was an event either, it's more likely that the
+				// input isn't one event per line at all.)
+				c.truncated()
+			}
+			continue
+		}
+
+		parsed = true
+		head.Reset()
+		c.handleEvent(event, line)
+		if err := c.stopReading(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// convertDocument handles a single JSON object with a top-level traceEvents
+// array. The array is decoded one element at a time so the whole trace
+// never needs to be in memory at once.
+func (c *Converter) convertDocument(r io.Reader) error {
+	dec := json.NewDecoder(r)
+	if err := expectDelim(dec, '{'); err != nil {
+		return c.readError("input", err)
+	}
+
+	// Standalone .cpuprofile files (from the DevTools JS profiler or node
+	// --cpu-prof) are a single CPU profile at the top level instead of a
+	// list of trace events.
+	var cpuProfile CPUProfileFile
+	cpuProfileFields := map[string]any{
+		"nodes":      &cpuProfile.Nodes,
+		"samples":    &cpuProfile.Samples,
+		"timeDeltas": &cpuProfile.TimeDeltas,
+		"startTime":  &cpuProfile.StartTime,
+		"endTime":    &cpuProfile.EndTime,
+	}
+	isCPUProfile := false
+
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return c.readError("input", err)
+		}
+
+		key, _ := tok.(string)
+		if key == "traceEvents" && c.opts.InputFormat == "cpuprofile" {
+			return errors.New("input has traceEvents, so it's a trace rather than a .cpuprofile")
+		}
+		if field, ok := cpuProfileFields[key]; ok && c.opts.InputFormat != "object" {
+			isCPUProfile = true
+			if err := dec.Decode(field); err != nil {
+				return c.readError(key, err)
+			}
+			continue
+		} else if key != "traceEvents" {
+			// Skip over anything else, like metadata.
+			var skip json.RawMessage
+			if err := dec.Decode(&skip); err != nil {
+				return c.readError("input", err)
+			}
+			continue
+		}
+
+		if err := c.convertEvents(dec, "traceEvents"); err != nil {
+			return err
+		}
+	}
+
+	if c.opts.InputFormat == "cpuprofile" && !isCPUProfile {
+		return errors.New("input has none of the fields of a .cpuprofile")
+	}
+	if isCPUProfile {
+		c.validated = true
+		c.convertCPUProfile(cpuProfile)
+	}
+	return nil
+}
+
+// convertArray handles a bare JSON array of trace events. Unlike the
+// streaming format, it can be laid out any which way.
+func (c *Converter) convertArray(br *bufio.Reader) error {
+	if isJSONDocument(br) {
+		return errors.New("input is a JSON object rather than an array")
+	}
+	dec := json.NewDecoder(br)
+	if err := c.convertEvents(dec, "input"); err != nil {
+		return err
+	}
+	if dec.More() {
+		return errors.New("input has more after the end of its array")
+	}
+	return nil
+}
+
+// convertEvents decodes a JSON array of trace events one element at a time,
+// so the whole array never needs to be in memory at once. what names the
+// array in errors.
+func (c *Converter) convertEvents(dec *json.Decoder, what string) error {
+	if err := expectDelim(dec, '['); err != nil {
+		return c.readError(what, err)
+	}
+	var compacted bytes.Buffer
+	for dec.More() {
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err != nil {
+			return c.readError("input", err)
+		}
+		c.offset = dec.InputOffset()
+
+		if err := c.checkShape(raw); err != nil {
+			return err
+		}
+
+		var event Event
+		if err := json.Unmarshal(raw, &event); err != nil {
+			c.warn(c.parseError(raw, fmt.Errorf("error reading event: %w", err)))
+			c.stats.ParseErrors++
+			continue
+		}
+
+		// These files are often pretty-printed, but pass-through events
+		// need to stay on one line like the rest of the output.
+		compacted.Reset()
+		must0(json.Compact(&compacted, raw))
+
+		c.handleEvent(event, compacted.String())
+		if err := c.stopReading(); err != nil {
+			return err
+		}
+	}
+	if err := expectDelim(dec, ']'); err != nil {
+		return c.readError(what, err)
+	}
+	return nil
+}
+
+// readError decides what to do about an error partway through reading the
+// input. Input that just stops was probably cut off by a crash rather than
+// broken, so everything up to that point is kept.
+func (c *Converter) readError(what string, err error) error {
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		c.truncated()
+		return nil
+	}
+	return fmt.Errorf("error reading %s: %w", what, err)
+}
+
+func (c *Converter) truncated() {
+	c.warn(ErrTruncated)
+	c.stats.Truncated = true
+}
+
+// A standalone .cpuprofile has no trace events to tell us which process and
+// thread it came from, so it gets made-up ones.
+const (
+	cpuProfilePid = 1
+	cpuProfileTid = 1
+)
+
+func (c *Converter) convertCPUProfile(p CPUProfileFile) {
+	pid, tid := c.pidOffset+cpuProfilePid, cpuProfileTid
+	if c.cpuProfileID != nil {
+		pid, tid = c.cpuProfileID.Pid, c.cpuProfileID.Tid
+	}
+	p.StartTime = c.micros(p.StartTime)
+	p.EndTime = c.micros(p.EndTime)
+	c.stats.Pids[pid] = true
+	proc := c.stats.process(pid)
+	proc.Profiles++
+	proc.Samples += len(p.Samples)
+	proc.Nodes += len(p.Nodes)
+	if !c.threadSelected(pid, tid) {
+		return
+	}
+	if c.opts.CountOnly {
+		profile := c.newProfile(profileKey{Pid: pid}, tid, p.StartTime)
+		c.timeChunk(profile, ProfileChunkArgsData{
+			CPUProfile: CPUProfile{Samples: p.Samples},
+			TimeDeltas: p.TimeDeltas,
+		})
+		return
+	}
+	if c.window != nil {
+		c.window.setOrigin(p.StartTime)
+	}
+
+	key := profileKey{Pid: pid}
+	if old, ok := c.profiles[key]; ok {
+		// Another thread of the same process.
+		c.run(old, old.closeStack)
+	}
+	profile := c.newProfile(key, tid, p.StartTime)
+	c.run(profile, func() {
+		c.processChunk(profile, ProfileChunkArgsData{
+			CPUProfile: CPUProfile{
+				Nodes:   p.Nodes,
+				Samples: p.Samples,
+			},
+			TimeDeltas: p.TimeDeltas,
+		})
+
+		// Whatever was running at the last sample ran until the profile
+		// ended.
+		profile.Time = max(profile.Time, p.EndTime)
+	})
+}
+
+// timeChunk works out when each of a chunk's samples was taken, the same as
+// processChunk, without converting them, for Options.CountOnly.
+func (c *Converter) timeChunk(profile *profileState, chunk ProfileChunkArgsData) {
+	numSamples := min(len(chunk.CPUProfile.Samples), len(chunk.TimeDeltas))
+	for _, delta := range chunk.TimeDeltas[:numSamples] {
+		profile.Time += max(c.micros(delta), 0)
+		profile.stats.sampleAt(profile.Time)
+	}
+}
+
+// micros converts a time from the input's timestamp unit to microseconds.
+func (c *Converter) micros(t float64) float64 {
+	switch c.opts.TimestampUnit {
+	case "ns":
+		return t / 1000
+	case "ms":
+		return t * 1000
+	default:
+		return t
+	}
+}
+
+// rewriteRaw updates the pid of a raw trace event, and scales its times to
+// microseconds, leaving everything else intact.
+func (c *Converter) rewriteRaw(raw string, pid int) ([]byte, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(raw), &fields); err != nil {
+		return nil, err
+	}
+	fields["pid"] = must1(json.Marshal(pid))
+	if c.opts.TimestampUnit != "us" {
+		for _, key := range []string{"ts", "dur", "tts", "tdur"} {
+			if value, ok := fields[key]; ok {
+				var t float64
+				if err := json.Unmarshal(value, &t); err != nil {
+					return nil, fmt.Errorf("%s: %w", key, err)
+				}
+				fields[key] = must1(json.Marshal(c.micros(t)))
+			}
+		}
+	}
+	return json.Marshal(fields)
+}
+
+func expectDelim(dec *json.Decoder, delim json.Delim) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if tok != delim {
+		return fmt.Errorf("expected %v but got %v", delim, tok)
+	}
+	return nil
+}
+
+func (c *Converter) handleEvent(event Event, raw string) {
+	if c.pidOffset != 0 || c.opts.TimestampUnit != "us" {
+		event.Pid += c.pidOffset
+		event.Time = c.micros(event.Time)
+		event.Duration = c.micros(event.Duration)
+		rewritten, err := c.rewriteRaw(raw, event.Pid)
+		if err != nil {
+			c.warn(c.parseError([]byte(raw), fmt.Errorf("failed to rewrite event: %w", err)))
+			c.stats.ParseErrors++
+			return
+		}
+		raw = string(rewritten)
+	}
+	c.stats.Pids[event.Pid] = true
+
+	if c.window != nil && event.Type != "M" {
+		// Metadata events don't have meaningful timestamps, so anything
+		// else is the start of the trace.
+		c.window.setOrigin(event.Time)
+	}
+	proc := c.stats.process(event.Pid)
+
+	if event.IsSpecialEvent(SpecialEventTracingStartedInBrowser) {
+		// This is passed through like any other event, too.
+		c.findMainFrame(event)
+	}
+
+	if event.IsSpecialEvent(SpecialEventProcessName) || event.IsSpecialEvent(SpecialEventThreadName) {
+		var args NameArgs
+		err := json.Unmarshal(event.Args, &args)
+		if err != nil {
+			c.warn(c.parseError([]byte(raw), fmt.Errorf("failed to read %s event: %w", event.Name, err)))
+			c.stats.ParseErrors++
+			return
+		}
+
+		// Remember names even for processes we aren't converting, in case
+		// one turns out to be the main renderer.
+		if event.Name == SpecialEventProcessName.Name {
+			proc.Name = args.Name
+			c.processNames[event.Pid] = args.Name
+			if !c.pidSelected(event.Pid) {
+				return
+			}
+			c.out.writeProcessName(event.Pid, c.processLabel(event.Pid, args.Name))
+		} else {
+			proc.ThreadNames[event.Tid] = args.Name
+			c.threadNames[threadID{event.Pid, event.Tid}] = args.Name
+			if !c.threadSelected(event.Pid, event.Tid) {
+				return
+			}
+			c.out.writeThreadName(event.Pid, event.Tid, args.Name)
+		}
+	} else if event.IsSpecialEvent(SpecialEventProfile) {
+		var args ProfileArgs
+		err := json.Unmarshal(event.Args, &args)
+		if err != nil {
+			c.warn(c.parseError([]byte(raw), fmt.Errorf("failed to read Profile event: %w", err)))
+			c.stats.ParseErrors++
+			return
+		}
+		proc.Profiles++
+
+		key := profileKey{event.Pid, string(event.ID)}
+		oldKeys := maps.Keys(c.profiles)
+		slices.SortFunc(oldKeys, profileKey.less)
+		for _, oldKey := range oldKeys {
+			old := c.profiles[oldKey]
+			if oldKey == key || (old.Pid == event.Pid && old.Tid == event.Tid) {
+				// The profiler was restarted. Close whatever the old
+				// profile still had open, since its samples end here.
+				c.run(old, old.closeStack)
+				delete(c.profiles, oldKey)
+			}
+		}
+
+		// Start over with an empty node table, rather than carrying over
+		// the old one. Each new profile numbers its nodes from scratch, so
+		// old nodes would only ever alias new ones with the wrong call
+		// frames.
+		profile := c.newProfile(key, event.Tid, c.micros(args.Data.StartTime))
+		c.processPendingChunks(profile)
+	} else if event.IsSpecialEvent(SpecialEventProfileChunk) {
+		// Filter on the profile rather than the chunk, since the profile
+		// knows which thread was actually sampled.
+		key := profileKey{event.Pid, string(event.ID)}
+		profile, ok := c.profiles[key]
+		if ok && !c.threadSelected(profile.Pid, profile.Tid) {
+			return
+		}
+
+		var args ProfileChunkArgs
+		err := json.Unmarshal(event.Args, &args)
+		if err != nil {
+			c.warn(c.parseError([]byte(raw), fmt.Errorf("failed to read ProfileChunk event: %w", err)))
+			c.stats.ParseErrors++
+			return
+		}
+		proc.Chunks++
+		proc.Samples += len(args.Data.CPUProfile.Samples)
+		proc.Nodes += len(args.Data.CPUProfile.Nodes)
+
+		if !ok && !c.opts.Streaming {
+			// Streamed traces aren't always in order, so hold on to the
+			// chunk until its Profile shows up.
+			c.pendingChunks[key] = append(c.pendingChunks[key], pendingChunk{
+				Tid:  event.Tid,
+				Data: args.Data,
+			})
+			return
+		} else if !ok {
+			// Holding on to chunks could take any amount of memory, so
+			// make do without the Profile, the same as if it never came.
+			c.warn(&ProcessError{event.Pid, fmt.Errorf("%w before its first ProfileChunk; assuming its profile started at 0", ErrNoProfileForPid)})
+			c.stats.OrphanChunks++
+			profile = c.newProfile(key, event.Tid, 0)
+			if !c.threadSelected(profile.Pid, profile.Tid) {
+				return
+			}
+		}
+
+		if c.opts.CountOnly {
+			c.timeChunk(profile, args.Data)
+		} else {
+			c.run(profile, func() {
+				c.processChunk(profile, args.Data)
+			})
+		}
+	} else if event.IsSpecialEvent(SpecialEventCpuProfile) {
+		// Chrome before version 58 recorded the whole profile in one
+		// event at the end, in the same shape as a .cpuprofile.
+		var args CpuProfileArgs
+		err := json.Unmarshal(event.Args, &args)
+		if err != nil {
+			c.warn(c.parseError([]byte(raw), fmt.Errorf("failed to read CpuProfile event: %w", err)))
+			c.stats.ParseErrors++
+			return
+		}
+		id := c.cpuProfileID
+		c.cpuProfileID = &threadID{event.Pid, event.Tid}
+		c.convertCPUProfile(args.Data.CPUProfile)
+		c.cpuProfileID = id
+	} else if !c.threadSelected(event.Pid, event.Tid) {
+		// filtered out
+	} else if c.opts.ExpandComplete && event.Type == "X" {
+		// A complete event is a whole frame in one. The window filter will
+		// trim it if it only partly overlaps the window. Both halves keep
+		// the duration, for traceEventLess.
+		c.traceOut().writeBeginEvent(Event{
+			Category: event.Category,
+			Name:     event.Name,
+			Type:     "B",
+			Pid:      event.Pid,
+			Tid:      event.Tid,
+			Time:     event.Time,
+			Duration: event.Duration,
+			Args:     event.Args,
+		})
+		c.traceOut().writeEndEvent(Event{
+			Category: event.Category,
+			Type:     "E",
+			Pid:      event.Pid,
+			Tid:      event.Tid,
+			Time:     event.Time + event.Duration,
+			Duration: event.Duration,
+		})
+	} else if c.window != nil && event.Type != "M" && !c.window.contains(event.Time) {
+		// outside the time window
+	} else if event.IsSpecialEvent(SpecialEventTimeStamp) {
+		// console.timeStamp(label)
+		var args TimeStampArgs
+		err := json.Unmarshal(event.Args, &args)
+		if err != nil {
+			c.warn(c.parseError([]byte(raw), fmt.Errorf("failed to read TimeStamp event: %w", err)))
+			c.stats.ParseErrors++
+			return
+		}
+		c.traceOut().writeMarker(Event{
+			Category: event.Category,
+			Name:     args.Data.Message,
+			Pid:      event.Pid,
+			Tid:      event.Tid,
+			Time:     event.Time,
+		})
+	} else if event.HasCategory("blink.console") && (event.Type == "b" || event.Type == "e") {
+		// console.time(label) and console.timeEnd(label), which Chrome
+		// records as an async span
+		name := event.Name
+		if event.Type == "e" {
+			name += " (end)"
+		}
+		c.traceOut().writeMarker(Event{
+			Category: event.Category,
+			Name:     name,
+			Pid:      event.Pid,
+			Tid:      event.Tid,
+			Time:     event.Time,
+		})
+	} else if c.opts.Flows && flowPhases[event.Type] != "" {
+		c.writeFlowMarker(event)
+	} else if c.passThroughSelected(event) {
+		// pass the line through unchanged
+		c.out.writePassThrough(raw)
+	}
+}
+
+// passThroughSelected reports whether an event that isn't converted should
+// be passed through, according to Options.KeepCategories and
+// Options.DropCategories.
+func (c *Converter) passThroughSelected(event Event) bool {
+	if len(c.opts.KeepCategories) > 0 && !event.HasAnyCategory(c.opts.KeepCategories) {
+		return false
+	}
+	return !event.HasAnyCategory(c.opts.DropCategories)
+}
+
+// flowPhases describes the events that tie one piece of work to another:
+// flow events, which connect a task to the place it was posted from, and
+// async events, which span threads. Each shares an id with the rest of its
+// chain.
+var flowPhases = map[string]string{
+	"s": "flow start",
+	"t": "flow step",
+	"f": "flow end",
+	"b": "async begin",
+	"n": "async instant",
+	"e": "async end",
+}
+
+// writeFlowMarker writes a flow or async event as an instant marker. Spall
+// has no way to draw a connection between two events, so instead every
+// marker in a chain is labeled with the same id, which is also in its args.
+func (c *Converter) writeFlowMarker(event Event) {
+	id := event.FlowID()
+	if id == "" {
+		c.warn(fmt.Errorf("skipping %s event %q with no id", flowPhases[event.Type], event.Name))
+		return
+	}
+	args := FlowArgs{ID: id, BindingPoint: event.BindingPoint}
+	c.traceOut().writeMarker(Event{
+		Category: event.Category,
+		Name:     fmt.Sprintf("%s (%s %s)", event.Name, flowPhases[event.Type], id),
+		Pid:      event.Pid,
+		Tid:      event.Tid,
+		Time:     event.Time,
+		Args:     must1(json.Marshal(args)),
+	})
+}
+
+// processChunk reconstructs the call stack from a chunk of samples, emitting
+// begin and end events as frames come and go.
+//
+// Each time delta is the time from the previous sample (or the start of the
+// profile) to this one, so adding it first gives this sample's own
+// timestamp. A sample then stands for the interval from its timestamp until
+// the next sample, the same as in DevTools: frames that appear in a sample
+// begin at its timestamp, and frames that are gone from it end there. (The
+// fudge offsets below nudge that by a few microseconds at most.) The last
+// sample's interval has no end, which is what Options.SampleInterval is for.
+func (c *Converter) processChunk(profile *profileState, chunk ProfileChunkArgsData) {
+	for _, node := range chunk.CPUProfile.Nodes {
+		profile.Nodes[node.ID] = node
+	}
+	// Nodes in .cpuprofile files list their children instead of their
+	// parent.
+	for _, node := range chunk.CPUProfile.Nodes {
+		for _, childID := range node.Children {
+			child := profile.Nodes[childID]
+			parent := node.ID
+			child.Parent = &parent
+			profile.Nodes[childID] = child
+		}
+	}
+
+	samples := chunk.CPUProfile.Samples
+	numSamples := min(len(samples), len(chunk.TimeDeltas))
+	if len(samples) != len(chunk.TimeDeltas) {
+		c.warn(&ProcessError{profile.Pid, fmt.Errorf("%w: %d samples but %d time deltas; ignoring the extras", ErrMismatchedChunk, len(samples), len(chunk.TimeDeltas))})
+		profile.stats.MismatchedChunks++
+	}
+	if c.opts.SampleInterval == "auto" && numSamples > 0 {
+		profile.Interval = c.micros(medianDelta(chunk.TimeDeltas[:numSamples]))
+	}
+
+	if c.opts.Smooth > 0 {
+		samples = smoothSamples(profile, samples[:numSamples], c.opts.Smooth)
+	}
+
+	for i := 0; i < numSamples; i++ {
+		topNodeID := samples[i]
+		topNode := profile.Nodes[topNodeID]
+		timeDelta := c.micros(chunk.TimeDeltas[i])
+
+		// Clock adjustments and merged chunks occasionally produce
+		// negative deltas. Time going backwards would put events before
+		// their parents' begins, so just hold still instead.
+		if timeDelta < 0 {
+			timeDelta = 0
+			profile.stats.ClampedDeltas++
+		}
+		// Move to this sample's timestamp before changing the stack; see
+		// above.
+		profile.tick(timeDelta)
+		profile.Time += timeDelta
+		profile.LastSample = profile.Time
+		profile.stats.sampleAt(profile.Time)
+
+		profile.stats.Samples++
+		profile.stats.SampledTime += timeDelta
+		if isGCNode(topNode) {
+			profile.stats.GCSamples++
+		} else if isIdleNode(topNode) {
+			profile.stats.IdleSamples++
+		}
+
+		// With downsampling, the samples in between are as if they never
+		// happened: whatever was on the stack stays there until the next
+		// sample that's kept.
+		profile.Sampled++
+		if c.opts.Downsample > 1 && (profile.Sampled-1)%c.opts.Downsample != 0 {
+			continue
+		}
+		profile.stats.KeptSamples++
+
+		currentTopID := noNode
+		if len(profile.Stack) > 0 {
+			currentTopID = profile.Stack[len(profile.Stack)-1]
+		}
+
+		if currentTopID == topNodeID {
+			// no change, keep on ticking
+		} else if isGCNode(topNode) && isGCNode(profile.Nodes[currentTopID]) {
+			// Still collecting garbage, even if V8 attributed this sample
+			// to a different GC node. Keep ticking rather than stacking
+			// another GC frame on top of the open one.
+		} else if isIdleNode(topNode) {
+			// The CPU was doing nothing, so nothing is on the stack. The
+			// idle node's only ancestor is (root), so treating it as a
+			// normal frame would invent phantom work.
+			profile.popStack(-1)
+			if c.opts.ShowIdle {
+				beginEvent := Event{
+					Category: c.frameCategory(topNode.CallFrame),
+					Color:    c.frameColor(topNode.CallFrame),
+					Name:     topNode.CallFrame.FunctionName,
+					Type:     "B",
+					Pid:      profile.Pid,
+					Tid:      profile.Tid,
+					Time:     profile.Time,
+				}
+				profile.push(topNodeID, beginEvent)
+			}
+		} else if isGCNode(topNode) {
+			// Garbage collections are special. Don't treat them as a
+			// stack change; push them as new events unconditionally, as
+			// children of whatever JS triggered them. They'll be popped
+			// by the next legitimate event.
+			if c.opts.GCAsSibling {
+				// V8's own tree puts GC beside the JS instead, right
+				// under (root).
+				profile.popStack(-1)
+			}
+			beginEvent := Event{
+				Category: c.frameCategory(topNode.CallFrame),
+				Color:    c.frameColor(topNode.CallFrame),
+				Name:     topNode.CallFrame.FunctionName,
+				Type:     "B",
+				Pid:      profile.Pid,
+				Tid:      profile.Tid,
+				Time:     profile.Time,
+			}
+			profile.push(topNodeID, beginEvent)
+		} else {
+			// Stack change! Starting at new top node, follow parents
+			// until you find an ancestor already in the stack (or
+			// exhaust the stack.) Pop the stack back to that ancestor,
+			// emitting end events. Then push all new nodes to the
+			// stack, emitting begin events.
+
+			// This will track the topmost node we want to keep.
+			ancestorIndex := -1
+
+			// First see if the top node is _in_ the stack. This means
+			// we are purely popping. If it's in there more than once
+			// (recursion), pop to the match nearest the top, the same as
+			// the parent walk below does.
+			for i := len(profile.Stack) - 1; i >= 0; i-- {
+				if profile.Stack[i] == topNodeID {
+					ancestorIndex = i
+					break
+				}
+			}
+
+			var nodesToBegin []int
+
+			// If we didn't find an ancestor yet, that means this is a
+			// new event. Starting from that new event, work back
+			// through the chain of parents until we find something in
+			// the stack.
+			if ancestorIndex < 0 {
+				newTopNode := profile.Nodes[topNodeID]
+				currentNodeID := newTopNode.ID
+
+			findancestor:
+				for currentNodeID != noNode {
+					for i := len(profile.Stack) - 1; i >= 0; i-- {
+						stackNode := profile.Stack[i]
+						if stackNode == currentNodeID {
+							ancestorIndex = i
+							break findancestor
+						}
+					}
+
+					if node := profile.Nodes[currentNodeID]; !c.isPseudoNode(node) && !(c.opts.SkipNative && isNativeNode(node)) && !c.nodeExcluded(profile, currentNodeID) {
+						nodesToBegin = append(nodesToBegin, currentNodeID)
+					}
+					currentNodeID = profile.Nodes[currentNodeID].parentID()
+				}
+			}
+
+			// Now, pop back to the ancestor...
+			profile.popStack(ancestorIndex)
+
+			// And then push the new events.
+			for i := len(nodesToBegin) - 1; i >= 0; i-- {
+				nodeID := nodesToBegin[i]
+				node := profile.Nodes[nodeID]
+				if c.opts.CollapseRecursion && len(profile.Stack) > 0 && profile.Nodes[profile.Stack[len(profile.Stack)-1]].CallFrame == node.CallFrame {
+					// The function called itself. Leave its existing frame
+					// open instead of nesting another one inside it.
+					continue
+				}
+				beginEvent := Event{
+					Category: c.frameCategory(node.CallFrame),
+					Color:    c.frameColor(node.CallFrame),
+					Name:     c.nodeName(profile, nodeID),
+					Type:     "B",
+					Pid:      profile.Pid,
+					Tid:      profile.Tid,
+					Time:     profile.Time + float64(min(len(nodesToBegin)-i, 49)), // fudge for spall's unstable sorts
+				}
+				if c.opts.EmitArgs {
+					beginEvent.Args = frameArgs(node.CallFrame)
+				}
+				if c.opts.TrackByOrigin {
+					beginEvent.Tid = originTrack(profile, node.CallFrame)
+				}
+				profile.push(nodeID, beginEvent)
+			}
+		}
+	}
+}
+
+func (c *Converter) finish() {
+	// Pop everything left on the stacks, so that frames which were still
+	// running when the profile ended get closed at the last sample time.
+	// Go through them in order, so that the output is the same every time.
+	keys := maps.Keys(c.profiles)
+	slices.SortFunc(keys, profileKey.less)
+	for _, key := range keys {
+		profile := c.profiles[key]
+		c.run(profile, profile.closeStack)
+	}
+	c.stopWorkers()
+	if c.traceEvents != nil {
+		// The trace's events aren't necessarily in order, and a complete
+		// event's end was written along with its begin, but once sorted,
+		// they can be merged like any profile's. They go first, so that at
+		// the same time, they come before the profiles' frames.
+		slices.SortStableFunc(c.traceEvents.events, traceEventLess)
+		c.buffers = append([]*bufferWriter{c.traceEvents}, c.buffers...)
+	}
+	c.mergeBuffers()
+
+	for _, profile := range c.allProfiles {
+		c.stats.Samples += profile.stats.Samples
+		c.stats.GCSamples += profile.stats.GCSamples
+		c.stats.IdleSamples += profile.stats.IdleSamples
+		c.stats.KeptSamples += profile.stats.KeptSamples
+		c.stats.SampledTime += profile.stats.SampledTime
+		c.stats.ClampedDeltas += profile.stats.ClampedDeltas
+		c.stats.ClampedEnds += profile.stats.ClampedEnds
+		c.stats.MismatchedChunks += profile.stats.MismatchedChunks
+		if profile.stats.Timed {
+			proc := c.stats.process(profile.Pid)
+			proc.see(profile.stats.FirstTime)
+			proc.see(profile.stats.LastTime)
+		}
+	}
+}
+
+// traceEventLess orders the frames and markers converted from the trace's
+// own events by time, so that they nest properly. At the same time, ends
+// come first, so that a frame can begin where another ended, except for
+// zero-length frames, which have to end after they begin. Longer frames
+// begin first and end last, so they enclose the shorter ones. Markers sort
+// like zero-length frames.
+func traceEventLess(a, b Event) bool {
+	if a.Time != b.Time {
+		return a.Time < b.Time
+	}
+	rank := func(e Event) int {
+		switch {
+		case e.Type == "E" && e.Duration > 0:
+			return 0
+		case e.Type == "E":
+			return 2
+		default:
+			return 1
+		}
+	}
+	if rank(a) != rank(b) {
+		return rank(a) < rank(b)
+	}
+	switch rank(a) {
+	case 0:
+		return a.Duration < b.Duration
+	case 1:
+		return a.Duration > b.Duration
+	}
+	return false
+}
+
+// traceOut is where to write the events converted from the trace's own
+// events, rather than from a profile.
+func (c *Converter) traceOut() eventWriter {
+	if c.traceEvents != nil {
+		return c.traceEvents
+	}
+	return c.out
+}
+
+// newProfile starts tracking a new profile for a process, replacing any
+// profile it already had.
+func (c *Converter) newProfile(key profileKey, tid int, startTime float64) *profileState {
+	profile := &profileState{
+		key:   key,
+		Pid:   key.Pid,
+		Tid:   tid,
+		Time:  startTime,
+		Nodes: make(map[int]Node),
+		Names: make(map[int]string),
+
+		LastEnd: math.Inf(-1),
+
+		Excluded: make(map[int]bool),
+		out:      c.out,
+
+		Tracks: make(map[string]bool),
+
+		MaxDepth: c.opts.MaxDepth,
+		SelfTime: c.opts.SelfTime,
+	}
+	if c.workers != nil || c.traceEvents != nil {
+		// Converting in parallel, or into spall's binary format, so hold on
+		// to the events until they can be merged in order.
+		buf := &bufferWriter{}
+		profile.out = buf
+		c.buffers = append(c.buffers, buf)
+	}
+	c.profiles[key] = profile
+	c.allProfiles = append(c.allProfiles, profile)
+	return profile
+}
+
+type threadID struct {
+	Pid, Tid int
+}
+
+func (id threadID) less(other threadID) bool {
+	if id.Pid != other.Pid {
+		return id.Pid < other.Pid
+	}
+	return id.Tid < other.Tid
+}
+
+// profileState tracks one V8 CPU profile as its chunks arrive.
+//
+// A profile samples exactly one thread, so every event we emit for it goes on
+// the thread that the Profile event came from. The ProfileChunk events
+// themselves are often posted from a different thread (V8's profiler
+// thread), so their tid is not the one to use.
+type profileState struct {
+	key      profileKey
+	Pid, Tid int
+	Time     float64
+	Nodes    map[int]Node
+	Stack    []int
+
+	// Open describes each frame on the Stack as it was written: when it
+	// began, so that it can't end before that, and the thread it went on.
+	Open []openFrame
+
+	// Tracks holds the origins that have had a track of their own named,
+	// with Options.TrackByOrigin.
+	Tracks map[string]bool
+
+	// Names memoizes the display name of each node, since the same few
+	// nodes are sampled over and over, and Excluded memoizes whether it's
+	// left out by Options.ExcludeFunctions.
+	Names    map[int]string
+	Excluded map[int]bool
+
+	// LastSample is the time of the most recent sample, and Interval is the
+	// typical time between samples, if Options.SampleInterval asked us to
+	// work it out.
+	LastSample float64
+	Interval   float64
+
+	// LastEnd is the time of the most recent end event, which the next
+	// ones can't come before, even when they're popped at the same time
+	// with a smaller fudge.
+	LastEnd float64
+
+	// Sampled counts the samples so far, for Options.Downsample.
+	Sampled int
+
+	// out is where the profile's events go, and stats counts its samples.
+	// Each profile has its own so that profiles can be converted in
+	// parallel.
+	out   eventWriter
+	stats sampleStats
+
+	// MaxDepth is how many frames deep the output may go, or zero for no
+	// limit. Frames beneath it are still tracked on the Stack, but their
+	// events are never written.
+	MaxDepth int
+
+	// SelfTime attaches each frame's self time to its end event, with
+	// Options.SelfTime.
+	SelfTime bool
+}
+
+// openFrame is a frame on the stack. Self is the time so far that it was
+// on top of the stack (or the deepest frame written, with MaxDepth).
+type openFrame struct {
+	Time     float64
+	Tid      int
+	Category string
+	Self     float64
+}
+
+// SelfTimeArgs are the args of an end event with Options.SelfTime.
+type SelfTimeArgs struct {
+	SelfTime float64 `json:"selfTime"` // in microseconds
+}
+
+// tick credits the time since the last sample to the frame on top of the
+// stack, since it was running the whole time.
+func (p *profileState) tick(delta float64) {
+	top := len(p.Open) - 1
+	if p.MaxDepth > 0 {
+		top = min(top, p.MaxDepth-1)
+	}
+	if top >= 0 {
+		p.Open[top].Self += delta
+	}
+}
+
+type sampleStats struct {
+	Samples, GCSamples, IdleSamples int
+	KeptSamples                     int
+	SampledTime                     float64
+	ClampedDeltas                   int
+	ClampedEnds                     int
+	MismatchedChunks                int
+
+	// FirstTime and LastTime are when the first and last samples were
+	// taken, if Timed is set.
+	FirstTime, LastTime float64
+	Timed               bool
+}
+
+// sampleAt records that a sample was taken at t. Samples only go forward in
+// time.
+func (s *sampleStats) sampleAt(t float64) {
+	if !s.Timed {
+		s.FirstTime = t
+		s.Timed = true
+	}
+	s.LastTime = t
+}
+
+// closeStack pops everything at the end of a profile. Normally frames end at
+// the next sample, but the last sample has no next one. With an interval,
+// the last sample is assumed to have run for one interval, so that frames
+// which only appeared in it are still visible.
+func (p *profileState) closeStack() {
+	p.Time = max(p.Time, p.LastSample+p.Interval)
+	p.tick(p.Time - p.LastSample)
+	p.popStack(-1)
+}
+
+// smoothSamples irons out stacks that flicker away for a moment: whenever a
+// stack comes back within n samples of leaving, the samples in between are
+// treated as more of it. Garbage collection and idle time are real even when
+// they're brief, so those samples are left alone.
+func smoothSamples(profile *profileState, samples []int, n int) []int {
+	special := func(id int) bool {
+		node := profile.Nodes[id]
+		return isGCNode(node) || isIdleNode(node)
+	}
+
+	smoothed := slices.Clone(samples)
+	for i := 1; i < len(smoothed); i++ {
+		prev := smoothed[i-1]
+		if smoothed[i] == prev || special(prev) {
+			continue
+		}
+	lookahead:
+		for j := i + 1; j <= i+n && j < len(smoothed); j++ {
+			if special(smoothed[j-1]) {
+				break
+			}
+			if smoothed[j] == prev {
+				for k := i; k < j; k++ {
+					smoothed[k] = prev
+				}
+				i = j
+				break lookahead
+			}
+		}
+	}
+	return smoothed
+}
+
+// medianDelta returns the median of a chunk's time deltas, ignoring the
+// negative ones that we'd clamp anyway.
+func medianDelta(deltas []float64) float64 {
+	sorted := make([]float64, 0, len(deltas))
+	for _, d := range deltas {
+		if d >= 0 {
+			sorted = append(sorted, d)
+		}
+	}
+	if len(sorted) == 0 {
+		return 0
+	}
+	slices.Sort(sorted)
+	return sorted[len(sorted)/2]
+}
+
+// push adds a node to the top of the stack, emitting its begin event.
+func (p *profileState) push(nodeID int, begin Event) {
+	if p.MaxDepth == 0 || len(p.Stack) < p.MaxDepth {
+		p.out.writeBeginEvent(begin)
+	}
+	p.Stack = append(p.Stack, nodeID)
+	p.Open = append(p.Open, openFrame{Time: begin.Time, Tid: begin.Tid, Category: begin.Category})
+}
+
+// popStack emits end events for every frame above ancestorIndex, topmost
+// first, and removes them from the stack. Pass -1 to pop everything.
+//
+// An end is never written before its frame began, which the fudge offsets
+// (or skewed timestamps) could otherwise cause. Such ends are moved up to
+// the begin, and so are the ends of the frames beneath them, to keep them
+// properly nested. Nor is an end written before the last one was, which
+// would otherwise happen when the stack is popped twice at the same time,
+// like at the end of a profile.
+func (p *profileState) popStack(ancestorIndex int) {
+	floor := math.Inf(-1)
+	for i := len(p.Stack) - 1; i > ancestorIndex; i-- {
+		if p.MaxDepth > 0 && i >= p.MaxDepth {
+			// Too deep to have been written.
+			p.Stack = p.Stack[:i]
+			p.Open = p.Open[:i]
+			continue
+		}
+		endEvent := Event{
+			Category: p.Open[i].Category,
+			Type:     "E",
+			Pid:      p.Pid,
+			Tid:      p.Open[i].Tid,
+			Time:     p.Time - float64(min(i-ancestorIndex, 49)), // fudge for spall's unstable sorts
+		}
+		if end := max(max(endEvent.Time, p.Open[i].Time), floor); end != endEvent.Time {
+			endEvent.Time = end
+			p.stats.ClampedEnds++
+		}
+		floor = endEvent.Time
+		endEvent.Time = max(endEvent.Time, p.LastEnd)
+		p.LastEnd = endEvent.Time
+		if p.SelfTime {
+			endEvent.Args = must1(json.Marshal(SelfTimeArgs{p.Open[i].Self}))
+		}
+		p.out.writeEndEvent(endEvent)
+		p.Stack = p.Stack[:i]
+		p.Open = p.Open[:i]
+	}
+}
+
+// findMainFrame reads the frames from a TracingStartedInBrowser event, to
+// learn which processes render top-level frames. Those are usually what
+// people are interested in, so they're labeled as such, and they're the ones
+// converted with Options.MainOnly.
+func (c *Converter) findMainFrame(event Event) {
+	var args TracingStartedInBrowserArgs
+	if err := json.Unmarshal(event.Args, &args); err != nil {
+		c.warn(c.parseError(event.Args, fmt.Errorf("failed to read TracingStartedInBrowser event: %w", err)))
+		c.stats.ParseErrors++
+		return
+	}
+
+	for _, frame := range args.Data.Frames {
+		if frame.Parent != "" {
+			continue // an iframe
+		}
+		pid := frame.ProcessID + c.pidOffset
+		c.foundMain = true
+		if c.mainPids[pid] {
+			continue
+		}
+		c.mainPids[pid] = true
+		c.stats.process(pid).Main = true
+		if !c.pidSelected(pid) {
+			continue
+		}
+
+		if c.opts.MainOnly {
+			// Until now we didn't know to keep this process, so its
+			// threads haven't been named yet.
+			var tids []int
+			for id := range c.threadNames {
+				if id.Pid == pid {
+					tids = append(tids, id.Tid)
+				}
+			}
+			slices.Sort(tids)
+			for _, tid := range tids {
+				if c.threadSelected(pid, tid) {
+					c.out.writeThreadName(pid, tid, c.threadNames[threadID{pid, tid}])
+				}
+			}
+		}
+		c.out.writeProcessName(pid, c.processLabel(pid, c.processNames[pid]))
+	}
+}
+
+// processLabel returns the name to give a process in the output, which calls
+// out the main renderer.
+func (c *Converter) processLabel(pid int, name string) string {
+	if !c.mainPids[pid] {
+		return name
+	}
+	if name == "" {
+		name = "Renderer"
+	}
+	return name + " (main frame)"
+}
+
+// pidSelected reports whether a process was chosen in Options.Pids, or true
+// if no processes were chosen.
+func (c *Converter) pidSelected(pid int) bool {
+	if c.opts.MainOnly && !c.mainPids[pid] {
+		return false
+	}
+	return len(c.opts.Pids) == 0 || slices.Contains(c.opts.Pids, pid)
+}
+
+// threadSelected reports whether a thread was chosen in Options.Pids and
+// Options.Tids.
+func (c *Converter) threadSelected(pid, tid int) bool {
+	return c.pidSelected(pid) && (len(c.opts.Tids) == 0 || slices.Contains(c.opts.Tids, tid))
+}
+
+// OriginPlaceholder in Options.Category is replaced by the origin of each
+// frame's script.
+const OriginPlaceholder = "{origin}"
+
+// frameCategory returns the category for a call frame's begin event.
+func (c *Converter) frameCategory(cf CallFrame) string {
+	category := c.opts.Category
+	if strings.Contains(category, OriginPlaceholder) {
+		origin := urlOrigin(cf.URL)
+		if origin == "" {
+			origin = "none"
+		}
+		category = strings.ReplaceAll(category, OriginPlaceholder, origin)
+	}
+	if c.opts.TagKind {
+		category += "," + frameKind(cf)
+	}
+	return category
+}
+
+// frameKind classifies a call frame as "js", "native", "gc", or "idle".
+func frameKind(cf CallFrame) string {
+	node := Node{CallFrame: cf}
+	switch {
+	case isGCNode(node):
+		return "gc"
+	case isIdleNode(node):
+		return "idle"
+	case cf.CodeType == "JS":
+		return "js"
+	case cf.CodeType == "":
+		// .cpuprofile files don't say, but only JS comes from a script.
+		if cf.URL != "" {
+			return "js"
+		}
+		return "native"
+	default:
+		return "native"
+	}
+}
+
+// The trace event format only allows colors from a fixed set of names. These
+// are the reserved colors that are easiest to tell apart.
+var frameColors = []string{
+	"thread_state_running",
+	"thread_state_runnable",
+	"thread_state_iowait",
+	"rail_response",
+	"rail_animation",
+	"rail_idle",
+	"rail_load",
+	"startup",
+	"good",
+	"bad",
+	"terrible",
+	"yellow",
+	"olive",
+}
+
+const (
+	appColor      = "good"
+	vendorColor   = "olive"
+	noURLColor    = "grey"
+	gcColor       = "terrible"
+	colorByOrigin = "origin"
+)
+
+// frameColor returns the color (cname) for a call frame's begin event, if
+// Options.ColorBy asks for one. Each origin gets a color of its own, picked
+// by hashing it so that it's the same from one trace to the next. With an
+// AppPrefix, there are only two colors: one for the app's scripts, and one for
+// everything else.
+func (c *Converter) frameColor(cf CallFrame) string {
+	if c.opts.ColorBy == "" {
+		return ""
+	}
+	if isGCNode(Node{CallFrame: cf}) {
+		return gcColor
+	}
+	if cf.URL == "" {
+		return noURLColor
+	}
+	if c.opts.AppPrefix != "" {
+		if strings.HasPrefix(cf.URL, c.opts.AppPrefix) {
+			return appColor
+		}
+		return vendorColor
+	}
+	h := fnv.New32a()
+	h.Write([]byte(urlOrigin(cf.URL)))
+	return frameColors[h.Sum32()%uint32(len(frameColors))]
+}
+
+// originTrack returns the tid of the track for a call frame's script origin,
+// with Options.TrackByOrigin, naming the track the first time it's used.
+// Tids are made by hashing the origin, so that each origin is on the same
+// track from one trace to the next. Frames without a script stay on the
+// profile's own thread.
+func originTrack(p *profileState, cf CallFrame) int {
+	origin := urlOrigin(cf.URL)
+	if origin == "" {
+		return p.Tid
+	}
+	h := fnv.New32a()
+	h.Write([]byte(origin))
+	tid := int(h.Sum32() & 0x7fffffff)
+	if !p.Tracks[origin] {
+		p.out.writeThreadName(p.Pid, tid, origin)
+		p.Tracks[origin] = true
+	}
+	return tid
+}
+
+// urlOrigin returns the scheme and host of a script URL, like
+// "https://example.com", or "" if it doesn't have one.
+func urlOrigin(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Scheme == "" {
+		return ""
+	}
+	if u.Host == "" {
+		// e.g. node:internal/modules
+		return u.Scheme + ":"
+	}
+	return u.Scheme + "://" + u.Host
+}
+
+// nodeName returns the display name of one of a profile's nodes.
+func (c *Converter) nodeName(p *profileState, id int) string {
+	name, ok := p.Names[id]
+	if !ok {
+		name = c.frameName(p.Nodes[id].CallFrame)
+		p.Names[id] = name
+	}
+	return name
+}
+
+// nodeExcluded reports whether a node's display name matches one of
+// Options.ExcludeFunctions.
+func (c *Converter) nodeExcluded(p *profileState, id int) bool {
+	if len(c.excludeFunctions) == 0 {
+		return false
+	}
+	excluded, ok := p.Excluded[id]
+	if !ok {
+		name := c.nodeName(p, id)
+		for _, re := range c.excludeFunctions {
+			if re.MatchString(name) {
+				excluded = true
+				break
+			}
+		}
+		p.Excluded[id] = excluded
+	}
+	return excluded
+}
+
+// FrameNameData is what an Options.NameTemplate is given for each frame.
+// Lines and columns are 1-based, like in DevTools.
+type FrameNameData struct {
+	FunctionName string
+	URL          string
+	Line, Col    int
+	ScriptID     ScriptID
+	CodeType     string
+}
+
+// frameName returns the display name for a call frame. Anonymous functions
+// are named by their source location, using 1-based lines and columns like
+// DevTools does.
+func (c *Converter) frameName(cf CallFrame) string {
+	if c.nameTemplate != nil && !c.nameTemplateFailed.Load() {
+		var name strings.Builder
+		err := c.nameTemplate.Execute(&name, FrameNameData{
+			FunctionName: cf.FunctionName,
+			URL:          cf.URL,
+			Line:         cf.LineNumber + 1,
+			Col:          cf.ColumnNumber + 1,
+			ScriptID:     cf.ScriptID,
+			CodeType:     cf.CodeType,
+		})
+		if err == nil {
+			return name.String()
+		}
+		if c.nameTemplateFailed.CompareAndSwap(false, true) {
+			c.warn(fmt.Errorf("failed to name frame, so using the usual names from here on: %w", err))
+		}
+	}
+
+	if cf.FunctionName != "" {
+		if c.opts.WithURL && cf.URL != "" {
+			return fmt.Sprintf("%s (%s:%d)", cf.FunctionName, cf.URL, cf.LineNumber+1)
+		}
+		return cf.FunctionName
+	}
+	if cf.URL != "" {
+		return fmt.Sprintf("(anonymous) %s:%d:%d", cf.URL, cf.LineNumber+1, cf.ColumnNumber+1)
+	}
+	if cf.CodeType == "other" {
+		// Engine internals don't have a script, so a location would be
+		// meaningless.
+		return "(native)"
+	}
+	return fmt.Sprintf("(anonymous %d:%d:%d)", cf.ScriptID, cf.LineNumber, cf.ColumnNumber)
+}
+
+// frameArgs describes where a call frame's code is, for the args of its begin
+// event. Lines and columns are 1-based, like in frame names.
+func frameArgs(cf CallFrame) json.RawMessage {
+	return must1(json.Marshal(struct {
+		URL      string   `json:"url"`
+		Line     int      `json:"line"`
+		Col      int      `json:"col"`
+		ScriptID ScriptID `json:"scriptId"`
+	}{cf.URL, cf.LineNumber + 1, cf.ColumnNumber + 1, cf.ScriptID}))
+}
+
+// .cpuprofile files don't record a codeType, so these check for anything but
+// JS. No JS function can have parentheses in its name anyway.
+
+func isGCNode(node Node) bool {
+	return node.CallFrame.CodeType != "JS" && node.CallFrame.FunctionName == "(garbage collector)"
+}
+
+func isIdleNode(node Node) bool {
+	return node.CallFrame.CodeType != "JS" && node.CallFrame.FunctionName == "(idle)"
+}
+
+// isNativeNode reports whether a node is native code inside the engine,
+// rather than JS or one of V8's special nodes. These are left out with
+// Options.SkipNative.
+func isNativeNode(node Node) bool {
+	if node.CallFrame.CodeType != "other" || isGCNode(node) || isIdleNode(node) {
+		return false
+	}
+	switch node.CallFrame.FunctionName {
+	case "(root)", "(program)":
+		return false
+	default:
+		return true
+	}
+}
+
+// isPseudoNode reports whether a node is one of V8's synthetic (root) or
+// (program) nodes, which don't represent any real code. (root) is the base of
+// every stack, and (program) is time spent in the engine outside of JS.
+func (c *Converter) isPseudoNode(node Node) bool {
+	switch node.CallFrame.FunctionName {
+	case "(root)":
+		return true
+	case "(program)":
+		return !c.opts.KeepProgram
+	default:
+		return false
+	}
+}
+
+type Event struct {
+	Name     string          `json:"name"`
+	Category string          `json:"cat"`
+	Type     string          `json:"ph"`
+	Time     float64         `json:"ts"`
+	Duration float64         `json:"dur"` // only for complete (X) events
+	Pid      int             `json:"pid"`
+	Tid      int             `json:"tid"`
+	Args     json.RawMessage `json:"args"`
+	ID       json.RawMessage `json:"id"` // ties ProfileChunks to their Profile
+	Color    string          `json:"cname,omitempty"`
+
+	// ID2 and BindingPoint are only for flow and async events. Newer
+	// versions of Chrome put their ids in ID2 instead of ID, and "e" binds
+	// a flow to the enclosing slice rather than the next one.
+	ID2          *FlowID2 `json:"id2,omitempty"`
+	BindingPoint string   `json:"bp,omitempty"`
+}
+
+// FlowID2 is a flow or async event's id, scoped either to its process or to
+// the whole trace.
+type FlowID2 struct {
+	Local  string `json:"local"`
+	Global string `json:"global"`
+}
+
+// FlowArgs is what a flow or async event's marker carries in its args.
+type FlowArgs struct {
+	ID           string `json:"id"`
+	BindingPoint string `json:"bp,omitempty"`
+}
+
+// FlowID returns a flow or async event's id, whether it's a string or a
+// number, or "" if it has none.
+func (e *Event) FlowID() string {
+	if e.ID2 != nil {
+		if e.ID2.Global != "" {
+			return e.ID2.Global
+		}
+		return e.ID2.Local
+	}
+	var id string
+	if json.Unmarshal(e.ID, &id) == nil {
+		return id
+	}
+	var n json.Number
+	if json.Unmarshal(e.ID, &n) == nil {
+		return n.String()
+	}
+	return ""
+}
+
+// Categories splits the event's comma-separated categories. Chrome doesn't
+// put spaces after the commas, but some other tools do, so each category is
+// trimmed.
+func (e *Event) Categories() []string {
+	cats := strings.Split(e.Category, ",")
+	for i, cat := range cats {
+		cats[i] = strings.TrimSpace(cat)
+	}
+	return cats
+}
+
+func (e *Event) HasCategory(cat string) bool {
+	for _, ecat := range e.Categories() {
+		if cat == ecat {
+			return true
+		}
+	}
+	return false
+}
+
+func (e *Event) HasAnyCategory(cats []string) bool {
+	for _, cat := range cats {
+		if e.HasCategory(cat) {
+			return true
+		}
+	}
+	return false
+}
+
+func (e *Event) IsSpecialEvent(se SpecialEvent) bool {
+	if e.Name != se.Name || (e.Type != se.Type && !slices.Contains(phaseAliases[se.Type], e.Type)) {
+		return false
+	}
+	if e.HasCategory(se.Cat) {
+		return true
+	}
+	for _, alias := range categoryAliases[se.Cat] {
+		if e.HasCategory(alias) {
+			return true
+		}
+	}
+	return false
+}
+
+// categoryAliases lists other spellings of a category that mean the same
+// thing. Newer versions of Chrome record high-resolution samples under a
+// separate category, but they're otherwise just like the usual ones.
+var categoryAliases = map[string][]string{
+	"disabled-by-default-v8.cpu_profiler": {"disabled-by-default-v8.cpu_profiler.hires"},
+}
+
+// phaseAliases lists other phases that the same events are recorded with.
+// "I" is the old spelling of instant events, and some emitters, like older
+// versions of Node's tracing, record CPU profile samples as instant events
+// instead of sample (P) events.
+var phaseAliases = map[string][]string{
+	"I": {"i"},
+	"P": {"I", "i"},
+}
+
+type SpecialEvent struct {
+	Cat, Type, Name string
+}
+
+var (
+	SpecialEventTracingStartedInBrowser = SpecialEvent{"disabled-by-default-devtools.timeline", "I", "TracingStartedInBrowser"}
+	SpecialEventProfile                 = SpecialEvent{"disabled-by-default-v8.cpu_profiler", "P", "Profile"}
+	SpecialEventProfileChunk            = SpecialEvent{"disabled-by-default-v8.cpu_profiler", "P", "ProfileChunk"}
+	SpecialEventCpuProfile              = SpecialEvent{"disabled-by-default-devtools.timeline", "I", "CpuProfile"}
+	SpecialEventTimeStamp               = SpecialEvent{"devtools.timeline", "I", "TimeStamp"}
+	SpecialEventProcessName             = SpecialEvent{"__metadata", "M", "process_name"}
+	SpecialEventThreadName              = SpecialEvent{"__metadata", "M", "thread_name"}
+)
+
+type TracingStartedInBrowserArgs struct {
+	Data struct {
+		Frames []struct {
+			Frame     string `json:"frame"`
+			Parent    string `json:"parent"`
+			ProcessID int    `json:"processId"`
+		} `json:"frames"`
+	} `json:"data"`
+}
+
+type TimeStampArgs struct {
+	Data struct {
+		Message string `json:"message"`
+	} `json:"data"`
+}
+
+type NameArgs struct {
+	Name string `json:"name"`
+}
+
+type ProfileArgs struct {
+	Data ProfileArgsData `json:"data"`
+}
+
+type ProfileArgsData struct {
+	StartTime float64 `json:"startTime"`
+}
+
+type CpuProfileArgs struct {
+	Data struct {
+		CPUProfile CPUProfileFile `json:"cpuProfile"`
+	} `json:"data"`
+}
+
+type ProfileChunkArgs struct {
+	Data ProfileChunkArgsData `json:"data"`
+}
+
+type ProfileChunkArgsData struct {
+	CPUProfile CPUProfile `json:"cpuProfile"`
+	// Lines      []int      `json:"lines"`
+	TimeDeltas []float64 `json:"timeDeltas"`
+}
+
+type CPUProfile struct {
+	Nodes   []Node `json:"nodes"`
+	Samples []int  `json:"samples"`
+}
+
+type Node struct {
+	CallFrame CallFrame `json:"callFrame"`
+	ID        int       `json:"id"`
+	Parent    *int      `json:"parent"` // nil for the root
+	Children  []int     `json:"children"`
+}
+
+// noNode stands in for a node ID where there's no node: the parent of the
+// root, or the top of an empty stack. V8 numbers nodes from 1, but other
+// tools start at 0, so 0 can't be used for this.
+const noNode = -1
+
+// parentID returns the ID of a node's parent, or noNode for the root.
+func (n Node) parentID() int {
+	if n.Parent == nil {
+		return noNode
+	}
+	return *n.Parent
+}
+
+// CPUProfileFile is the contents of a standalone .cpuprofile file.
+type CPUProfileFile struct {
+	Nodes      []Node    `json:"nodes"`
+	StartTime  float64   `json:"startTime"`
+	EndTime    float64   `json:"endTime"`
+	Samples    []int     `json:"samples"`
+	TimeDeltas []float64 `json:"timeDeltas"`
+}
+
+type CallFrame struct {
+	CodeType     string   `json:"codeType"`
+	FunctionName string   `json:"functionName"`
+	LineNumber   int      `json:"lineNumber"`
+	ColumnNumber int      `json:"columnNumber"`
+	ScriptID     ScriptID `json:"scriptId"`
+	URL          string   `json:"url"`
+}
+
+// ScriptID identifies a script in a V8 profile. Chrome writes it as a number,
+// but some versions of Chrome and Node write it as a string instead.
+type ScriptID int
+
+func (id *ScriptID) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return fmt.Errorf("invalid scriptId %q: %w", s, err)
+		}
+		*id = ScriptID(n)
+		return nil
+	}
+
+	var n int
+	if err := json.Unmarshal(data, &n); err != nil {
+		return err
+	}
+	*id = ScriptID(n)
+	return nil
+}
+
+func must0(err error) {
+	if err != nil {
+		panic(err)
+	}
+}
+
+func must1[T any](v T, err error) T {
+	if err != nil {
+		panic(err)
+	}
+	return v
+}
+
+func min[T constraints.Ordered](a, b T) T {
+	if a < b {
+		return a
+	} else {
+		return b
+	}
+}
+
+func max[T constraints.Ordered](a, b T) T {
+	if a > b {
+		return a
+	} else {
+		return b
+	}
+}
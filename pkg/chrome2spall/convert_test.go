@@ -0,0 +1,1342 @@
+package chrome2spall
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+	"testing"
+
+	"golang.org/x/exp/maps"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// TestGolden converts each trace in testdata and compares the output with
+// the .golden file next to it. Run with -update to rewrite the golden files
+// after a deliberate change to the output, and check the diff.
+func TestGolden(t *testing.T) {
+	inputs, err := filepath.Glob(filepath.Join("testdata", "*.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(inputs) == 0 {
+		t.Fatal("no traces in testdata")
+	}
+
+	for _, input := range inputs {
+		name := strings.TrimSuffix(filepath.Base(input), ".json")
+		t.Run(name, func(t *testing.T) {
+			out := convertFile(t, input, Options{})
+
+			golden := strings.TrimSuffix(input, ".json") + ".golden"
+			if *update {
+				if err := os.WriteFile(golden, out, 0o666); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(out, want) {
+				t.Errorf("output differs from %s:\n got: %s\nwant: %s", golden, out, want)
+			}
+		})
+	}
+}
+
+// TestJSONLines checks that unwrapped JSON output, pass-through events
+// included, is one comma-terminated event per line between brackets on lines
+// of their own, however the input was laid out.
+func TestJSONLines(t *testing.T) {
+	in, err := os.ReadFile(filepath.Join("testdata", "nested.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var events []json.RawMessage
+	for _, line := range strings.Split(string(in), "\n") {
+		if line = strings.Trim(line, "[],"); line != "" {
+			events = append(events, json.RawMessage(line))
+		}
+	}
+
+	layouts := map[string][]byte{
+		"lines":         in,
+		"pretty array":  must1(json.MarshalIndent(events, "", "  ")),
+		"pretty object": must1(json.MarshalIndent(map[string]any{"traceEvents": events}, "", "  ")),
+	}
+	for name, in := range layouts {
+		t.Run(name, func(t *testing.T) {
+			var out bytes.Buffer
+			if _, err := Convert(bytes.NewReader(in), &out, Options{}); err != nil {
+				t.Fatal(err)
+			}
+			lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+			if first, last := lines[0], lines[len(lines)-1]; first != "[" || last != "]" {
+				t.Errorf("output is between %q and %q, want brackets", first, last)
+			}
+			passedThrough := 0
+			for _, line := range lines[1 : len(lines)-1] {
+				var e struct {
+					Ph string `json:"ph"`
+				}
+				if !strings.HasSuffix(line, ",") || json.Unmarshal([]byte(strings.TrimSuffix(line, ",")), &e) != nil {
+					t.Errorf("line %q isn't an event followed by a comma", line)
+				}
+				if e.Ph == "X" {
+					passedThrough++
+				}
+			}
+			if passedThrough == 0 {
+				t.Error("no events were passed through")
+			}
+		})
+	}
+	t.Run("wrapped", func(t *testing.T) {
+		var out bytes.Buffer
+		if _, err := Convert(bytes.NewReader(in), &out, Options{Wrap: true}); err != nil {
+			t.Fatal(err)
+		}
+		if !json.Valid(out.Bytes()) {
+			t.Errorf("wrapped output isn't valid JSON:\n%s", out.Bytes())
+		}
+	})
+}
+
+// convertFile converts the trace at path, failing the test if that fails.
+func convertFile(t *testing.T, path string, opts Options) []byte {
+	t.Helper()
+	in, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return convertBytes(t, in, opts)
+}
+
+// convertBytes converts the trace in, failing the test if that fails.
+func convertBytes(t *testing.T, in []byte, opts Options) []byte {
+	t.Helper()
+	var out bytes.Buffer
+	if _, err := Convert(bytes.NewReader(in), &out, opts); err != nil {
+		t.Fatal(err)
+	}
+	return out.Bytes()
+}
+
+// outputEvent is the part of an event in the JSON output that tests look
+// at.
+type outputEvent struct {
+	Name string          `json:"name"`
+	Cat  string          `json:"cat"`
+	Ph   string          `json:"ph"`
+	Ts   float64         `json:"ts"`
+	Dur  float64         `json:"dur"`
+	Pid  int             `json:"pid"`
+	Tid  int             `json:"tid"`
+	Args json.RawMessage `json:"args"`
+}
+
+// jsonEvents reads back the events in unwrapped JSON output.
+func jsonEvents(t *testing.T, out []byte) []outputEvent {
+	t.Helper()
+	var events []outputEvent
+	for _, line := range strings.Split(string(out), "\n") {
+		line = strings.TrimSuffix(line, ",")
+		if line == "[" || line == "]" || line == "" {
+			continue
+		}
+		var e outputEvent
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			t.Fatalf("bad event %q: %v", line, err)
+		}
+		events = append(events, e)
+	}
+	return events
+}
+
+// frameEvents describes each function frame's begin and end in JSON output,
+// one per line, as its type, its name if it's a begin, and its time.
+func frameEvents(t *testing.T, out []byte) []string {
+	t.Helper()
+	var frames []string
+	for _, e := range jsonEvents(t, out) {
+		switch {
+		case e.Cat != "function":
+		case e.Ph == "B":
+			frames = append(frames, fmt.Sprintf("B %s %v", e.Name, e.Ts))
+		default:
+			frames = append(frames, fmt.Sprintf("E %v", e.Ts))
+		}
+	}
+	return frames
+}
+
+// testNodes is a call tree for made-up profiles, with V8's pseudo-frames:
+//
+//	1 (root)
+//	  2 (program)
+//	  3 main
+//	    4 render
+//	      5 layout
+//	  6 (garbage collector)
+//	  7 (idle)
+var testNodes = []Node{
+	{ID: 1, CallFrame: CallFrame{CodeType: "other", FunctionName: "(root)"}},
+	{ID: 2, Parent: ptr(1), CallFrame: CallFrame{CodeType: "other", FunctionName: "(program)"}},
+	{ID: 3, Parent: ptr(1), CallFrame: CallFrame{CodeType: "JS", FunctionName: "main", ScriptID: 5, URL: "https://example.com/app.js"}},
+	{ID: 4, Parent: ptr(3), CallFrame: CallFrame{CodeType: "JS", FunctionName: "render", ScriptID: 5, URL: "https://example.com/app.js", LineNumber: 10}},
+	{ID: 5, Parent: ptr(4), CallFrame: CallFrame{CodeType: "JS", FunctionName: "layout", ScriptID: 5, URL: "https://example.com/app.js", LineNumber: 20}},
+	{ID: 6, Parent: ptr(1), CallFrame: CallFrame{CodeType: "other", FunctionName: "(garbage collector)"}},
+	{ID: 7, Parent: ptr(1), CallFrame: CallFrame{CodeType: "other", FunctionName: "(idle)"}},
+}
+
+func ptr[T any](v T) *T { return &v }
+
+// profileTrace makes up a trace with one profile, on pid 10 and tid 20,
+// starting at 1000us. Its one chunk has the given nodes, and a sample of
+// each of the given node IDs 100us apart.
+func profileTrace(nodes []Node, samples []int) []byte {
+	deltas := make([]float64, len(samples))
+	for i := range deltas {
+		deltas[i] = 100
+	}
+	return profileTraceDeltas(nodes, samples, deltas)
+}
+
+// profileTraceDeltas is like profileTrace, but with the given time deltas
+// between samples.
+func profileTraceDeltas(nodes []Node, samples []int, deltas []float64) []byte {
+	return traceOf(
+		map[string]any{
+			"name": "thread_name", "cat": "__metadata", "ph": "M", "pid": 10, "tid": 20,
+			"args": map[string]any{"name": "CrRendererMain"},
+		},
+		profileEvent("0x1", 1000),
+		chunkEvent("0x1", nodes, samples, deltas),
+	)
+}
+
+// profileEvent and chunkEvent make up a profile's events on pid 10 and tid
+// 20.
+func profileEvent(id string, startTime float64) map[string]any {
+	return map[string]any{
+		"name": "Profile", "cat": "disabled-by-default-v8.cpu_profiler", "ph": "P", "id": id, "pid": 10, "tid": 20, "ts": startTime,
+		"args": map[string]any{"data": map[string]any{"startTime": startTime}},
+	}
+}
+
+func chunkEvent(id string, nodes []Node, samples []int, deltas []float64) map[string]any {
+	return map[string]any{
+		"name": "ProfileChunk", "cat": "disabled-by-default-v8.cpu_profiler", "ph": "P", "id": id, "pid": 10, "tid": 20, "ts": 1000,
+		"args": map[string]any{"data": map[string]any{
+			"cpuProfile": map[string]any{"nodes": nodes, "samples": samples},
+			"timeDeltas": deltas,
+		}},
+	}
+}
+
+// traceOf writes events out as a trace in Chrome's streaming format.
+func traceOf(events ...any) []byte {
+	var out bytes.Buffer
+	out.WriteString("[\n")
+	for _, e := range events {
+		out.Write(must1(json.Marshal(e)))
+		out.WriteString(",\n")
+	}
+	return out.Bytes()
+}
+
+// TestInputLayouts converts the same trace laid out in each of the ways
+// that the input format is worked out from, and expects the same output.
+func TestInputLayouts(t *testing.T) {
+	lines, err := os.ReadFile(filepath.Join("testdata", "nested.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var events []json.RawMessage
+	for _, line := range strings.Split(string(lines), "\n") {
+		if line = strings.Trim(line, "[],"); line != "" {
+			events = append(events, json.RawMessage(line))
+		}
+	}
+	want, err := os.ReadFile(filepath.Join("testdata", "nested.golden"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	layouts := map[string][]byte{
+		"lines":         lines,
+		"closed lines":  append(lines, "]\n"...),
+		"compact array": must1(json.Marshal(events)),
+		"pretty array":  must1(json.MarshalIndent(events, "", "  ")),
+		"object":        must1(json.Marshal(map[string]any{"traceEvents": events})),
+		"pretty object": must1(json.MarshalIndent(map[string]any{"traceEvents": events}, "", "  ")),
+	}
+	// Traces saved on Windows can have CRLF line endings, and some Windows
+	// tools start the file with a byte order mark.
+	for _, name := range maps.Keys(layouts) {
+		layouts[name+" with CRLF"] = bytes.ReplaceAll(layouts[name], []byte("\n"), []byte("\r\n"))
+	}
+	for _, name := range maps.Keys(layouts) {
+		layouts[name+" with BOM"] = append([]byte("\uFEFF"), layouts[name]...)
+	}
+	for name, in := range layouts {
+		t.Run(name, func(t *testing.T) {
+			var out bytes.Buffer
+			var warnings []error
+			opts := Options{Warn: func(err error) { warnings = append(warnings, err) }}
+			if _, err := Convert(bytes.NewReader(in), &out, opts); err != nil {
+				t.Fatal(err)
+			}
+			if len(warnings) > 0 {
+				t.Errorf("unexpected warnings: %v", warnings)
+			}
+			if !bytes.Equal(out.Bytes(), want) {
+				t.Errorf("got:\n%s\nwant:\n%s", out.Bytes(), want)
+			}
+		})
+	}
+}
+
+// TestLongLines converts chunks on lines far longer than bufio.Scanner's
+// default limit, and expects every sample in them.
+func TestLongLines(t *testing.T) {
+	tests := []struct {
+		name    string
+		samples int
+		minLine int // bytes
+	}{
+		{"short", 10, 0},
+		{"over 64KB", 20_000, 64 << 10},
+		{"over 2MB", 400_000, 2 << 20},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			samples := make([]int, test.samples)
+			for i := range samples {
+				samples[i] = 3 + i%3 // main, render, layout
+			}
+			trace := profileTrace(testNodes, samples)
+			lines := bytes.Split(trace, []byte("\n"))
+			if chunk := lines[len(lines)-2]; len(chunk) < test.minLine {
+				t.Fatalf("the chunk is only %d bytes", len(chunk))
+			}
+
+			stats, err := Convert(bytes.NewReader(trace), io.Discard, Options{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stats.Samples != test.samples || stats.ParseErrors != 0 {
+				t.Errorf("converted %d samples with %d parse errors, want %d samples", stats.Samples, stats.ParseErrors, test.samples)
+			}
+		})
+	}
+}
+
+func TestNotATrace(t *testing.T) {
+	text := strings.Repeat("just some text\n", 200)
+	tests := []struct {
+		name  string
+		in    string
+		force bool
+		want  error
+	}{
+		{"text", text, false, ErrNotATrace},
+		{"text with force", text, true, nil},
+		{"short text", "hello\n", false, ErrNotATrace},
+		{"empty", "", false, ErrNotATrace},
+		{"objects that aren't events", strings.Repeat(`{"a":1}`+"\n", 200), false, ErrNotATrace},
+		{"JSON document that isn't a trace", `{"hello":"world"}`, false, ErrNotATrace},
+		{"empty trace", "[\n", false, ErrNotATrace},
+		{"one event", `[{"name":"thread_name","ph":"M","pid":1,"tid":1,"args":{"name":"main"}}]`, false, nil},
+		{"event after the text", "hello\n" + `{"name":"x","ph":"I","pid":1,"tid":1,"ts":0}` + "\n", false, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := Convert(strings.NewReader(test.in), io.Discard, Options{Force: test.force})
+			if !errors.Is(err, test.want) {
+				t.Errorf("got error %v, want %v", err, test.want)
+			}
+		})
+	}
+}
+
+// TestStreamingMemory converts a trace bigger than the memory it's allowed
+// with Streaming, laid out in each of the ways it can be, and watches the heap
+// as the input is read. (Buffered, the binary output alone takes gigabytes.)
+func TestStreamingMemory(t *testing.T) {
+	if testing.Short() {
+		t.Skip("converts a large trace")
+	}
+	const (
+		size  = 16 << 20 // of the input
+		limit = 12 << 20 // of the heap in use
+	)
+	samples := make([]int, 1000)
+	deltas := make([]float64, len(samples))
+	for i := range samples {
+		samples[i], deltas[i] = 3+i%3, 100
+	}
+	profile := must1(json.Marshal(profileEvent("0x1", 1000)))
+	first := must1(json.Marshal(chunkEvent("0x1", testNodes, samples, deltas)))
+	chunk := must1(json.Marshal(chunkEvent("0x1", nil, samples, deltas)))
+	// A pretty-printed array has its events spread over several lines.
+	spread := func(event []byte) string {
+		return string(bytes.Replace(event, []byte(`{"args":`), []byte("{\n    \"args\":"), 1))
+	}
+
+	tests := []struct {
+		name               string
+		head, repeat, tail string
+		format             string
+	}{
+		{"lines", fmt.Sprintf("[%s,\n%s,\n", profile, first), string(chunk) + ",\n", "", "json"},
+		{"array", fmt.Sprintf("[\n  %s,\n  %s", spread(profile), spread(first)), ",\n  " + spread(chunk), "\n]\n", "json"},
+		{"object", fmt.Sprintf(`{"traceEvents":[%s,%s`, profile, first), "," + string(chunk), "]}\n", "json"},
+		{"binary", fmt.Sprintf("[%s,\n%s,\n", profile, first), string(chunk) + ",\n", "", "binary"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			n := size / len(test.repeat)
+			r := &heapReader{countingReader: countingReader{r: io.MultiReader(
+				strings.NewReader(test.head),
+				&repeatReader{s: test.repeat, n: n},
+				strings.NewReader(test.tail),
+			)}}
+			runtime.GC()
+			stats, err := Convert(r, io.Discard, Options{Streaming: true, Format: test.format})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := (n + 1) * len(samples); stats.Samples != want {
+				t.Errorf("converted %d samples, want %d", stats.Samples, want)
+			}
+			if r.n < size {
+				t.Errorf("read only %d bytes", r.n)
+			}
+			if r.peak > limit {
+				t.Errorf("%d bytes of heap were in use, over the limit of %d", r.peak, limit)
+			}
+		})
+	}
+}
+
+// repeatReader reads s over and over, n times.
+type repeatReader struct {
+	s   string
+	n   int
+	off int
+}
+
+func (rr *repeatReader) Read(p []byte) (int, error) {
+	read := 0
+	for read < len(p) && rr.n > 0 {
+		c := copy(p[read:], rr.s[rr.off:])
+		read += c
+		rr.off += c
+		if rr.off == len(rr.s) {
+			rr.off = 0
+			rr.n--
+		}
+	}
+	if read == 0 {
+		return 0, io.EOF
+	}
+	return read, nil
+}
+
+// heapReader counts what's read from it like countingReader, and looks at
+// how much heap is in use after every megabyte.
+type heapReader struct {
+	countingReader
+	next int    // the count to look at the heap at next
+	peak uint64 // the most heap in use seen
+}
+
+func (hr *heapReader) Read(p []byte) (int, error) {
+	n, err := hr.countingReader.Read(p)
+	if hr.n >= hr.next {
+		var ms runtime.MemStats
+		runtime.ReadMemStats(&ms)
+		hr.peak = max(hr.peak, ms.HeapInuse)
+		hr.next = hr.n + 1<<20
+	}
+	return n, err
+}
+
+func TestTruncated(t *testing.T) {
+	lines, err := os.ReadFile(filepath.Join("testdata", "nested.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var events []json.RawMessage
+	for _, line := range strings.Split(string(lines), "\n") {
+		if line = strings.Trim(line, "[],"); line != "" {
+			events = append(events, json.RawMessage(line))
+		}
+	}
+	compact := must1(json.Marshal(events))
+
+	tests := []struct {
+		name   string
+		in     []byte
+		format string
+		want   bool
+	}{
+		{"whole", lines, "", false},
+		{"cut off in the last event", lines[:len(lines)-20], "", true},
+		{"compact array read as lines", compact, "ndjson", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			stats, _ := Convert(bytes.NewReader(test.in), io.Discard, Options{InputFormat: test.format, Force: true})
+			if stats.Truncated != test.want {
+				t.Errorf("Truncated is %v, want %v", stats.Truncated, test.want)
+			}
+		})
+	}
+}
+
+// TestBadPassThroughTimes converts with a TimestampUnit, which rescales the
+// times of passed-through events, and expects one whose tts isn't a number to
+// be left out with a ParseError rather than stop the conversion.
+func TestBadPassThroughTimes(t *testing.T) {
+	in, err := os.ReadFile(filepath.Join("testdata", "nested.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	in = append(in, `{"args":{},"cat":"toplevel","dur":10,"name":"Bad","ph":"X","pid":10,"tid":20,"ts":1000,"tts":"soon"},`+"\n"...)
+
+	var warnings []error
+	var out bytes.Buffer
+	stats, err := Convert(bytes.NewReader(in), &out, Options{TimestampUnit: "ns", Warn: func(err error) { warnings = append(warnings, err) }})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var perr *ParseError
+	if stats.ParseErrors != 1 || len(warnings) != 1 || !errors.As(warnings[0], &perr) {
+		t.Errorf("got %d parse errors and warnings %v, want one ParseError", stats.ParseErrors, warnings)
+	}
+	frames, bad := 0, 0
+	for _, e := range jsonEvents(t, out.Bytes()) {
+		if e.Ph == "B" {
+			frames++
+		}
+		if e.Name == "Bad" {
+			bad++
+		}
+	}
+	if frames == 0 || bad != 0 {
+		t.Errorf("got %d frames and %d bad events, want some frames and no bad events", frames, bad)
+	}
+}
+
+func TestScriptID(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    ScriptID
+		wantErr bool
+	}{
+		{`42`, 42, false},
+		{`"42"`, 42, false},
+		{`0`, 0, false},
+		{`"0"`, 0, false},
+		{`""`, 0, true},
+		{`"abc"`, 0, true},
+		{`4.5`, 0, true},
+		{`true`, 0, true},
+	}
+	for _, test := range tests {
+		var id ScriptID
+		err := json.Unmarshal([]byte(test.in), &id)
+		if (err != nil) != test.wantErr || id != test.want {
+			t.Errorf("%s is read as %d with error %v, want %d (error: %v)", test.in, id, err, test.want, test.wantErr)
+		}
+	}
+
+	// Node writes the scriptIds as strings.
+	in, err := os.ReadFile(filepath.Join("testdata", "nested.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := os.ReadFile(filepath.Join("testdata", "nested.golden"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	quoted := regexp.MustCompile(`"scriptId":(\d+)`).ReplaceAll(in, []byte(`"scriptId":"$1"`))
+	if bytes.Equal(quoted, in) {
+		t.Fatal("no scriptIds to quote")
+	}
+	if out := convertBytes(t, quoted, Options{}); !bytes.Equal(out, want) {
+		t.Errorf("got:\n%s\nwant:\n%s", out, want)
+	}
+}
+
+func TestHasCategory(t *testing.T) {
+	tests := []struct {
+		cats, cat string
+		want      bool
+	}{
+		{"a,b", "b", true},
+		{"a, b", "b", true},
+		{" a ,\tb ", "a", true},
+		{"a, b", " b", false},
+		{"ab", "a", false},
+		{"", "a", false},
+	}
+	for _, test := range tests {
+		e := Event{Category: test.cats}
+		if got := e.HasCategory(test.cat); got != test.want {
+			t.Errorf("HasCategory(%q) on %q is %v, want %v", test.cat, test.cats, got, test.want)
+		}
+	}
+}
+
+// TestSpacedCategories lists the profile's categories with spaces after the
+// commas, and expects it to convert just the same.
+func TestSpacedCategories(t *testing.T) {
+	in, err := os.ReadFile(filepath.Join("testdata", "nested.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := os.ReadFile(filepath.Join("testdata", "nested.golden"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	spaced := strings.ReplaceAll(string(in), `"cat":"disabled-by-default-v8.cpu_profiler"`, `"cat":"v8, disabled-by-default-v8.cpu_profiler"`)
+	if out := convertBytes(t, []byte(spaced), Options{}); !bytes.Equal(out, want) {
+		t.Errorf("got:\n%s\nwant:\n%s", out, want)
+	}
+}
+
+// TestHiresCategory converts a profile recorded under the .hires
+// cpu_profiler category, and expects the same frames as for the usual one.
+func TestHiresCategory(t *testing.T) {
+	want := frameEvents(t, convertFile(t, filepath.Join("testdata", "nested.json"), Options{}))
+	got := frameEvents(t, convertFile(t, filepath.Join("testdata", "hires.json"), Options{}))
+	if len(want) == 0 {
+		t.Fatal("nested.json gave no frames")
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got frames:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+// TestFrameCategory sets the frames' category in each of the ways it can be
+// set, and expects every end to have the same category as its begin.
+func TestFrameCategory(t *testing.T) {
+	tests := []struct {
+		name string
+		opts Options
+	}{
+		{"default", Options{}},
+		{"category", Options{Category: "foo"}},
+		{"origin", Options{Category: "js " + OriginPlaceholder}},
+		{"tag kind", Options{Category: "foo", TagKind: true}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			open := make(map[int][]string)
+			ends := 0
+			for _, e := range jsonEvents(t, convertFile(t, filepath.Join("testdata", "nested.json"), test.opts)) {
+				switch e.Ph {
+				case "B":
+					open[e.Tid] = append(open[e.Tid], e.Cat)
+				case "E":
+					stack := open[e.Tid]
+					if len(stack) == 0 {
+						t.Fatalf("end at %v has no begin", e.Ts)
+					}
+					if begin := stack[len(stack)-1]; e.Cat != begin {
+						t.Errorf("end at %v has category %q, but its begin has %q", e.Ts, e.Cat, begin)
+					}
+					open[e.Tid] = stack[:len(stack)-1]
+					ends++
+				}
+			}
+			if ends == 0 {
+				t.Error("no frames were written")
+			}
+		})
+	}
+}
+
+// TestCloseAtEOF ends profiles in the middle of calls, and expects the frames
+// still open to be closed at the last sample, or an interval after it with
+// SampleInterval. Ends never come before their begin, nor before the ends
+// already written.
+func TestCloseAtEOF(t *testing.T) {
+	tests := []struct {
+		name     string
+		samples  []int
+		interval string
+		want     []string
+		clamped  int
+	}{
+		{"nested", []int{3, 4, 5, 4}, "", []string{
+			"B main 1101", "B render 1201", "B layout 1301", "E 1399", "E 1399", "E 1399",
+		}, 0},
+		{"nested with interval", []int{3, 4, 5, 4}, "auto", []string{
+			"B main 1101", "B render 1201", "B layout 1301", "E 1399", "E 1498", "E 1499",
+		}, 0},
+		{"deepest in the last sample", []int{3, 4, 5}, "", []string{
+			"B main 1101", "B render 1201", "B layout 1301", "E 1301", "E 1301", "E 1301",
+		}, 3},
+		{"deepest in the last sample with interval", []int{3, 4, 5}, "auto", []string{
+			"B main 1101", "B render 1201", "B layout 1301", "E 1397", "E 1398", "E 1399",
+		}, 0},
+		{"one sample", []int{3}, "", []string{"B main 1101", "E 1101"}, 1},
+		{"in garbage collection", []int{3, 4, 6, 6, 4}, "", []string{
+			"B main 1101", "B render 1201", "B (garbage collector) 1300", "E 1499", "E 1499", "E 1499",
+		}, 0},
+		{"out of the program", []int{2, 3, 4, 2}, "", []string{
+			"B main 1201", "B render 1301", "E 1398", "E 1399",
+		}, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var out bytes.Buffer
+			stats, err := Convert(bytes.NewReader(profileTrace(testNodes, test.samples)), &out, Options{SampleInterval: test.interval})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := frameEvents(t, out.Bytes()); strings.Join(got, "\n") != strings.Join(test.want, "\n") {
+				t.Errorf("got frames:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(test.want, "\n"))
+			}
+			if stats.ClampedEnds != test.clamped {
+				t.Errorf("ClampedEnds is %d, want %d", stats.ClampedEnds, test.clamped)
+			}
+		})
+	}
+}
+
+// TestNegativeDeltas expects negative time deltas to count as zero, so that
+// time never goes backwards.
+func TestNegativeDeltas(t *testing.T) {
+	tests := []struct {
+		name    string
+		deltas  []float64
+		want    []string
+		clamped int
+	}{
+		{"none", []float64{100, 100, 100, 100}, []string{
+			"B main 1101", "B render 1201", "B layout 1301", "E 1399", "E 1399", "E 1399",
+		}, 0},
+		{"zero", []float64{100, 0, 100, 100}, []string{
+			"B main 1101", "B render 1101", "B layout 1201", "E 1299", "E 1299", "E 1299",
+		}, 0},
+		{"small", []float64{100, 100, -50, 100}, []string{
+			"B main 1101", "B render 1201", "B layout 1201", "E 1299", "E 1299", "E 1299",
+		}, 1},
+		{"before the start", []float64{100, -500, 100, 100}, []string{
+			"B main 1101", "B render 1101", "B layout 1201", "E 1299", "E 1299", "E 1299",
+		}, 1},
+		{"last", []float64{100, 100, 100, -1}, []string{
+			"B main 1101", "B render 1201", "B layout 1301", "E 1301", "E 1301", "E 1301",
+		}, 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var out bytes.Buffer
+			trace := profileTraceDeltas(testNodes, []int{3, 4, 5, 4}, test.deltas)
+			stats, err := Convert(bytes.NewReader(trace), &out, Options{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := frameEvents(t, out.Bytes()); strings.Join(got, "\n") != strings.Join(test.want, "\n") {
+				t.Errorf("got frames:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(test.want, "\n"))
+			}
+			if stats.ClampedDeltas != test.clamped {
+				t.Errorf("ClampedDeltas is %d, want %d", stats.ClampedDeltas, test.clamped)
+			}
+		})
+	}
+}
+
+// TestRestartedProfile starts a second profile on the same thread, while the
+// first still has frames open. Those are closed at the first profile's last
+// sample, and the second profile starts with a node table of its own: its
+// node 4 isn't the first profile's render.
+func TestRestartedProfile(t *testing.T) {
+	restarted := []Node{testNodes[0], {ID: 3, Parent: ptr(1), CallFrame: CallFrame{CodeType: "JS", FunctionName: "other"}}}
+	want := []string{
+		"B main 1101", "B render 1201", "B layout 1301", "E 1301", "E 1301", "E 1301",
+		"B other 2101", "E 2199", "B (anonymous 0:0:0) 2201", "E 2299", "B other 2301", "E 2301",
+	}
+	for _, test := range []struct {
+		name, id string
+	}{
+		{"same id", "0x1"},
+		{"new id", "0x2"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			trace := traceOf(
+				profileEvent("0x1", 1000),
+				chunkEvent("0x1", testNodes, []int{3, 4, 5}, []float64{100, 100, 100}),
+				profileEvent(test.id, 2000),
+				chunkEvent(test.id, restarted, []int{3, 4, 3}, []float64{100, 100, 100}),
+			)
+			var out bytes.Buffer
+			stats, err := Convert(bytes.NewReader(trace), &out, Options{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := frameEvents(t, out.Bytes()); strings.Join(got, "\n") != strings.Join(want, "\n") {
+				t.Errorf("got frames:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+			}
+			if profiles := stats.Processes[10].Profiles; profiles != 2 {
+				t.Errorf("counted %d profiles, want 2", profiles)
+			}
+		})
+	}
+}
+
+// TestRecursion samples a directly recursive function at several depths.
+// Each level of the recursion is a node of its own, so returning from some
+// of them pops exactly that many frames.
+func TestRecursion(t *testing.T) {
+	nodes := []Node{
+		testNodes[0],
+		{ID: 2, Parent: ptr(1), CallFrame: CallFrame{CodeType: "JS", FunctionName: "f"}},
+		{ID: 3, Parent: ptr(2), CallFrame: CallFrame{CodeType: "JS", FunctionName: "f"}},
+		{ID: 4, Parent: ptr(3), CallFrame: CallFrame{CodeType: "JS", FunctionName: "f"}},
+		{ID: 5, Parent: ptr(3), CallFrame: CallFrame{CodeType: "JS", FunctionName: "g"}},
+	}
+	tests := []struct {
+		name     string
+		samples  []int
+		collapse bool
+		want     []string
+	}{
+		{"down and up", []int{2, 3, 4, 3, 2}, false, []string{
+			"B f 1101", "B f 1201", "B f 1301", "E 1399", "E 1499", "E 1499",
+		}},
+		{"jumps", []int{4, 2, 4}, false, []string{
+			"B f 1101", "B f 1102", "B f 1103", "E 1198", "E 1199", "B f 1301", "B f 1302", "E 1302", "E 1302", "E 1302",
+		}},
+		{"sibling", []int{4, 5, 3}, false, []string{
+			"B f 1101", "B f 1102", "B f 1103", "E 1199", "B g 1201", "E 1299", "E 1299", "E 1299",
+		}},
+		{"down and up collapsed", []int{2, 3, 4, 3, 2}, true, []string{"B f 1101", "E 1499"}},
+		{"jumps collapsed", []int{4, 2, 4}, true, []string{"B f 1101", "E 1299"}},
+		{"sibling collapsed", []int{4, 5, 3}, true, []string{"B f 1101", "B g 1202", "E 1299", "E 1299"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			out := convertBytes(t, profileTrace(nodes, test.samples), Options{CollapseRecursion: test.collapse})
+			if got := frameEvents(t, out); strings.Join(got, "\n") != strings.Join(test.want, "\n") {
+				t.Errorf("got frames:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(test.want, "\n"))
+			}
+		})
+	}
+}
+
+// TestFractionalTimes expects time deltas with fractions of a microsecond to
+// keep them, in both formats.
+func TestFractionalTimes(t *testing.T) {
+	tests := []struct {
+		name   string
+		deltas []float64
+		want   []string
+	}{
+		{"quarters", []float64{100.25, 100.5, 100.125, 100}, []string{
+			"B main 1101.25", "B render 1201.75", "B layout 1301.875", "E 1399.875", "E 1399.875", "E 1399.875",
+		}},
+		{"under a microsecond", []float64{100, 0.001, 100, 100}, []string{
+			"B main 1101", "B render 1101.001", "B layout 1201.001", "E 1299.001", "E 1299.001", "E 1299.001",
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			trace := profileTraceDeltas(testNodes, []int{3, 4, 5, 4}, test.deltas)
+			if got := frameEvents(t, convertBytes(t, trace, Options{})); strings.Join(got, "\n") != strings.Join(test.want, "\n") {
+				t.Errorf("got JSON frames:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(test.want, "\n"))
+			}
+			if got := binaryEvents(t, convertBytes(t, trace, Options{Format: "binary"})); strings.Join(got, "\n") != strings.Join(test.want, "\n") {
+				t.Errorf("got binary frames:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(test.want, "\n"))
+			}
+		})
+	}
+}
+
+// TestChunkOrder moves a profile's chunks ahead of its Profile event, which
+// has the time they count from, or leaves it out altogether.
+func TestChunkOrder(t *testing.T) {
+	profile := profileEvent("0x1", 1000)
+	first := chunkEvent("0x1", testNodes, []int{3, 4, 3}, []float64{100, 100, 100})
+	second := chunkEvent("0x1", nil, []int{4, 3}, []float64{100, 100})
+	tests := []struct {
+		name     string
+		events   []any
+		want     []string
+		orphans  int
+		warnings int
+	}{
+		{"in order", []any{profile, first}, []string{"B main 1101", "B render 1201", "E 1299", "E 1299"}, 0, 0},
+		{"chunk first", []any{first, profile}, []string{"B main 1101", "B render 1201", "E 1299", "E 1299"}, 0, 0},
+		{"two chunks first", []any{first, second, profile}, []string{
+			"B main 1101", "B render 1201", "E 1299", "B render 1401", "E 1499", "E 1499",
+		}, 0, 0},
+		{"between chunks", []any{first, profile, second}, []string{
+			"B main 1101", "B render 1201", "E 1299", "B render 1401", "E 1499", "E 1499",
+		}, 0, 0},
+		{"no profile", []any{first}, []string{"B main 101", "B render 201", "E 299", "E 299"}, 1, 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var out bytes.Buffer
+			var warnings []error
+			opts := Options{Warn: func(err error) { warnings = append(warnings, err) }}
+			stats, err := Convert(bytes.NewReader(traceOf(test.events...)), &out, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := frameEvents(t, out.Bytes()); strings.Join(got, "\n") != strings.Join(test.want, "\n") {
+				t.Errorf("got frames:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(test.want, "\n"))
+			}
+			if stats.OrphanChunks != test.orphans || len(warnings) != test.warnings {
+				t.Errorf("got %d orphan chunks and warnings %v, want %d and %d", stats.OrphanChunks, warnings, test.orphans, test.warnings)
+			}
+		})
+	}
+}
+
+func TestMaxDepth(t *testing.T) {
+	// A chain of 20 calls, d1 to d20, sampled all the way down, then partway
+	// back up, then down again.
+	nodes := []Node{testNodes[0]}
+	for i := 1; i <= 20; i++ {
+		nodes = append(nodes, Node{ID: i + 1, Parent: ptr(i), CallFrame: CallFrame{CodeType: "JS", FunctionName: fmt.Sprintf("d%d", i)}})
+	}
+	samples := []int{21, 4, 21, 9, 21}
+
+	tests := []struct {
+		maxDepth, want int
+	}{
+		{0, 20},
+		{1, 1},
+		{5, 5},
+		{10, 10},
+		{20, 20},
+		{25, 20},
+	}
+	for _, test := range tests {
+		t.Run(fmt.Sprint(test.maxDepth), func(t *testing.T) {
+			depth, deepest := 0, 0
+			names := make(map[string]bool)
+			for _, e := range jsonEvents(t, convertBytes(t, profileTrace(nodes, samples), Options{MaxDepth: test.maxDepth})) {
+				switch {
+				case e.Cat != "function":
+				case e.Ph == "B":
+					depth++
+					deepest = max(deepest, depth)
+					if e.Name != fmt.Sprintf("d%d", depth) {
+						t.Errorf("%s is at depth %d", e.Name, depth)
+					}
+					names[e.Name] = true
+				default:
+					depth--
+				}
+			}
+			if deepest != test.want || depth != 0 {
+				t.Errorf("frames went %d deep and ended at %d, want %d deep and back to 0", deepest, depth, test.want)
+			}
+			if !names[fmt.Sprintf("d%d", test.want)] {
+				t.Errorf("no frames at depth %d", test.want)
+			}
+		})
+	}
+}
+
+// TestSampleTimes checks that frames begin at the first sample they're in,
+// and end at the first one they're gone from, with each time delta counting
+// from the sample before (or the start of the profile, at 1000us).
+func TestSampleTimes(t *testing.T) {
+	tests := []struct {
+		name    string
+		samples []int
+		deltas  []float64
+		want    []string
+	}{
+		{"uneven", []int{3, 4, 5, 3}, []float64{50, 100, 200, 400}, []string{
+			"B main 1051", "B render 1151", "B layout 1351", "E 1748", "E 1749", "E 1749",
+		}},
+		{"at the start", []int{3, 4, 5, 3}, []float64{0, 100, 100, 100}, []string{
+			"B main 1001", "B render 1101", "B layout 1201", "E 1298", "E 1299", "E 1299",
+		}},
+		{"all at once", []int{5, 3}, []float64{10, 90}, []string{
+			"B main 1011", "B render 1012", "B layout 1013", "E 1098", "E 1099", "E 1099",
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			out := convertBytes(t, profileTraceDeltas(testNodes, test.samples, test.deltas), Options{})
+			if got := frameEvents(t, out); strings.Join(got, "\n") != strings.Join(test.want, "\n") {
+				t.Errorf("got frames:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(test.want, "\n"))
+			}
+		})
+	}
+}
+
+// TestProfilesSharingPid has two threads of one process profiled at once,
+// with node IDs that mean different functions in each profile.
+func TestProfilesSharingPid(t *testing.T) {
+	worker := []Node{
+		testNodes[0],
+		{ID: 3, Parent: ptr(1), CallFrame: CallFrame{CodeType: "JS", FunctionName: "onmessage"}},
+		{ID: 4, Parent: ptr(3), CallFrame: CallFrame{CodeType: "JS", FunctionName: "crunch"}},
+	}
+	workerProfile := profileEvent("0x2", 1050)
+	workerProfile["tid"] = 21
+	mainFirst := chunkEvent("0x1", testNodes, []int{3, 4}, []float64{100, 100})
+	mainSecond := chunkEvent("0x1", nil, []int{4, 3}, []float64{100, 100})
+	workerFirst := chunkEvent("0x2", worker, []int{3, 4}, []float64{100, 100})
+	workerSecond := chunkEvent("0x2", nil, []int{4, 3}, []float64{100, 100})
+
+	tests := []struct {
+		name   string
+		events []any
+	}{
+		{"one after the other", []any{profileEvent("0x1", 1000), workerProfile, mainFirst, mainSecond, workerFirst, workerSecond}},
+		{"interleaved", []any{profileEvent("0x1", 1000), workerProfile, mainFirst, workerFirst, mainSecond, workerSecond}},
+	}
+	want := map[int][]string{
+		20: {"B main 1101", "B render 1201", "E 1399", "E 1399"},
+		21: {"B onmessage 1151", "B crunch 1251", "E 1449", "E 1449"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := make(map[int][]string)
+			for _, e := range jsonEvents(t, convertBytes(t, traceOf(test.events...), Options{})) {
+				switch {
+				case e.Cat != "function":
+				case e.Ph == "B":
+					got[e.Tid] = append(got[e.Tid], fmt.Sprintf("B %s %v", e.Name, e.Ts))
+				default:
+					got[e.Tid] = append(got[e.Tid], fmt.Sprintf("E %v", e.Ts))
+				}
+			}
+			for tid, frames := range want {
+				if strings.Join(got[tid], "\n") != strings.Join(frames, "\n") {
+					t.Errorf("got frames on tid %d:\n%s\nwant:\n%s", tid, strings.Join(got[tid], "\n"), strings.Join(frames, "\n"))
+				}
+			}
+		})
+	}
+}
+
+func TestPseudoFrames(t *testing.T) {
+	tests := []struct {
+		name        string
+		samples     []int
+		keepProgram bool
+		want        []string
+	}{
+		{"program", []int{2, 3, 4, 2}, false, []string{
+			"B main 1201", "B render 1301", "E 1398", "E 1399",
+		}},
+		{"program kept", []int{2, 3, 4, 2}, true, []string{
+			"B (program) 1101", "E 1199", "B main 1201", "B render 1301", "E 1398", "E 1399", "B (program) 1401", "E 1401",
+		}},
+		{"program twice", []int{2, 2, 3}, false, []string{"B main 1301", "E 1301"}},
+		{"program twice kept", []int{2, 2, 3}, true, []string{"B (program) 1101", "E 1299", "B main 1301", "E 1301"}},
+		{"root", []int{1, 3, 1}, false, []string{"B main 1201", "E 1299"}},
+		{"root with program kept", []int{1, 3, 1}, true, []string{"B main 1201", "E 1299"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			out := convertBytes(t, profileTrace(testNodes, test.samples), Options{KeepProgram: test.keepProgram})
+			if got := frameEvents(t, out); strings.Join(got, "\n") != strings.Join(test.want, "\n") {
+				t.Errorf("got frames:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(test.want, "\n"))
+			}
+			if bytes.Contains(out, []byte("(root)")) {
+				t.Errorf("(root) is in the output:\n%s", out)
+			}
+		})
+	}
+}
+
+func TestGarbageCollection(t *testing.T) {
+	tests := []struct {
+		name    string
+		samples []int
+		want    []string
+	}{
+		{"once", []int{3, 6, 3}, []string{"B main 1101", "B (garbage collector) 1200", "E 1299", "E 1299"}},
+		{"three in a row", []int{3, 6, 6, 6, 3}, []string{"B main 1101", "B (garbage collector) 1200", "E 1499", "E 1499"}},
+		{"twice", []int{3, 6, 3, 6, 3}, []string{
+			"B main 1101", "B (garbage collector) 1200", "E 1299", "B (garbage collector) 1400", "E 1499", "E 1499",
+		}},
+		{"first", []int{6, 6, 3}, []string{"B (garbage collector) 1100", "E 1299", "B main 1301", "E 1301"}},
+		{"deeper", []int{3, 4, 6, 6, 4}, []string{
+			"B main 1101", "B render 1201", "B (garbage collector) 1300", "E 1499", "E 1499", "E 1499",
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			out := convertBytes(t, profileTrace(testNodes, test.samples), Options{})
+			if got := frameEvents(t, out); strings.Join(got, "\n") != strings.Join(test.want, "\n") {
+				t.Errorf("got frames:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(test.want, "\n"))
+			}
+		})
+	}
+}
+
+func TestSelfTime(t *testing.T) {
+	out := convertFile(t, filepath.Join("testdata", "nested.json"), Options{SelfTime: true})
+	// main is on top for a sample at the start, one in the middle, and one
+	// at the end, after paint.
+	want := map[string]float64{"main": 300, "render": 200, "layout": 200, "paint": 200}
+
+	got := make(map[string]float64)
+	var stack []string
+	for _, e := range jsonEvents(t, out) {
+		switch e.Ph {
+		case "B":
+			stack = append(stack, e.Name)
+		case "E":
+			var args SelfTimeArgs
+			if err := json.Unmarshal(e.Args, &args); err != nil {
+				t.Fatalf("bad args on the end of %s: %v", stack[len(stack)-1], err)
+			}
+			got[stack[len(stack)-1]] += args.SelfTime
+			stack = stack[:len(stack)-1]
+		}
+	}
+	for name, self := range want {
+		if got[name] != self {
+			t.Errorf("%s's self time is %v, want %v", name, got[name], self)
+		}
+	}
+}
+
+func TestExcludeFunctions(t *testing.T) {
+	tests := []struct {
+		name    string
+		exclude []string
+		want    []string
+	}{
+		{"none", nil, []string{
+			"B main 1111", "B render 1211", "B layout 1311", "E 1509", "E 1609", "B paint 1711", "E 1909", "E 2009",
+		}},
+		{"middle", []string{"^render$"}, []string{
+			"B main 1111", "B layout 1311", "E 1509", "B paint 1711", "E 1909", "E 2009",
+		}},
+		{"bottom", []string{"^main$"}, []string{
+			"B render 1211", "B layout 1311", "E 1509", "E 1609", "B paint 1711", "E 1909",
+		}},
+		{"several", []string{"^render$", "^pa"}, []string{
+			"B main 1111", "B layout 1311", "E 1509", "E 2009",
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			out := convertFile(t, filepath.Join("testdata", "nested.json"), Options{ExcludeFunctions: test.exclude})
+			if got := frameEvents(t, out); strings.Join(got, "\n") != strings.Join(test.want, "\n") {
+				t.Errorf("got frames:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(test.want, "\n"))
+			}
+		})
+	}
+}
+
+// TestNameTemplateFailure uses a template that works on some frames and not
+// others, and expects one warning about it.
+func TestNameTemplateFailure(t *testing.T) {
+	in, err := os.ReadFile(filepath.Join("testdata", "nested.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var warnings []error
+	opts := Options{
+		NameTemplate: "{{if .URL}}{{slice .URL 0 100}}{{else}}{{.FunctionName}}{{end}}",
+		Warn:         func(err error) { warnings = append(warnings, err) },
+	}
+	var out bytes.Buffer
+	if _, err := Convert(bytes.NewReader(in), &out, opts); err != nil {
+		t.Fatal(err)
+	}
+	if len(warnings) != 1 {
+		t.Errorf("got %d warnings, want 1: %v", len(warnings), warnings)
+	}
+}
+
+// TestDeterministic converts the same trace several times over, and expects
+// the same output and stats each time. The profiles are all still open at
+// the end, and are spread over several processes, so anything that depends
+// on the order of a map shows up.
+func TestDeterministic(t *testing.T) {
+	trace := generateTrace(8, 500)
+	for _, test := range []struct {
+		name string
+		opts Options
+	}{
+		{"json", Options{}},
+		{"binary", Options{Format: "binary"}},
+		{"streaming", Options{Streaming: true}},
+		{"concurrency track", Options{ConcurrencyTrack: true}},
+		{"merge threads", Options{MergeThreads: true}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			var want []byte
+			for run := 0; run < 5; run++ {
+				var out bytes.Buffer
+				stats, err := Convert(bytes.NewReader(trace), &out, test.opts)
+				if err != nil {
+					t.Fatal(err)
+				}
+				stats.PrintProcesses(&out)
+				if run == 0 {
+					want = out.Bytes()
+				} else if !bytes.Equal(out.Bytes(), want) {
+					t.Fatalf("run %d differs from the first", run)
+				}
+			}
+		})
+	}
+
+	t.Run("split", func(t *testing.T) {
+		var want map[int][]byte
+		for run := 0; run < 5; run++ {
+			outputs := make(map[int]*bytes.Buffer)
+			opts := Options{SplitOutput: func(pid int) (io.WriteCloser, error) {
+				outputs[pid] = &bytes.Buffer{}
+				return nopCloser{outputs[pid]}, nil
+			}}
+			if _, err := Convert(bytes.NewReader(trace), io.Discard, opts); err != nil {
+				t.Fatal(err)
+			}
+			got := make(map[int][]byte)
+			for pid, out := range outputs {
+				got[pid] = out.Bytes()
+			}
+			if run == 0 {
+				want = got
+				continue
+			}
+			for pid := range want {
+				if !bytes.Equal(got[pid], want[pid]) {
+					t.Fatalf("run %d differs from the first for pid %d", run, pid)
+				}
+			}
+		}
+	})
+}
+
+type nopCloser struct{ io.Writer }
+
+func (nopCloser) Close() error { return nil }
+
+func BenchmarkConvert(b *testing.B) {
+	trace := generateTrace(8, 20_000)
+	for _, bench := range []struct {
+		name string
+		opts Options
+	}{
+		{"serial", Options{}},
+		{"jobs", Options{Jobs: 4}},
+		{"binary", Options{Format: "binary"}},
+		{"streaming", Options{Streaming: true}},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			b.SetBytes(int64(len(trace)))
+			for i := 0; i < b.N; i++ {
+				if _, err := Convert(bytes.NewReader(trace), io.Discard, bench.opts); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// generateTrace makes up a trace in Chrome's streaming format, with the given
+// number of profiles and samples in each. Each profile is in a process of
+// its own, since that's what's spread across workers with Options.Jobs. The
+// stacks wander up and down a call tree a few levels at a time, like a real
+// program's, and are the same every time.
+func generateTrace(profiles, samples int) []byte {
+	const (
+		depth     = 12
+		fanout    = 4
+		chunkSize = 1000
+	)
+	rng := rand.New(rand.NewSource(1))
+	var out bytes.Buffer
+	out.WriteString("[\n")
+	writeEvent := func(e any) {
+		out.Write(must1(json.Marshal(e)))
+		out.WriteString(",\n")
+	}
+
+	for p := 0; p < profiles; p++ {
+		pid, tid, id := 10+p, 20, "0x1"
+		writeEvent(map[string]any{
+			"name": "thread_name", "cat": "__metadata", "ph": "M", "pid": pid, "tid": tid,
+			"args": map[string]any{"name": "CrRendererMain"},
+		})
+		writeEvent(map[string]any{
+			"name": "Profile", "cat": "disabled-by-default-v8.cpu_profiler", "ph": "P", "id": id, "pid": pid, "tid": tid, "ts": 1000,
+			"args": map[string]any{"data": map[string]any{"startTime": 1000}},
+		})
+
+		// Nodes are numbered as they're first sampled, and each one's
+		// children are found by their position under it.
+		children := map[[2]int]int{} // parent and position to child
+		var stack []int              // node IDs, from (root)
+		nextID := 2
+		for n := 0; n < samples; n += chunkSize {
+			var nodes []Node
+			var ids []int
+			var deltas []int
+			for i := n; i < n+chunkSize && i < samples; i++ {
+				if len(stack) == 0 {
+					stack = []int{1}
+					nodes = append(nodes, Node{ID: 1, CallFrame: CallFrame{CodeType: "other", FunctionName: "(root)"}})
+				}
+				// Return from a few frames, then call a few.
+				stack = stack[:max(len(stack)-rng.Intn(3), 1)]
+				for calls := rng.Intn(3); calls > 0 && len(stack) < depth; calls-- {
+					parent := stack[len(stack)-1]
+					key := [2]int{parent, rng.Intn(fanout)}
+					child, ok := children[key]
+					if !ok {
+						child = nextID
+						nextID++
+						children[key] = child
+						nodes = append(nodes, Node{
+							ID:     child,
+							Parent: &parent,
+							CallFrame: CallFrame{
+								CodeType:     "JS",
+								FunctionName: fmt.Sprintf("f%d", child),
+								ScriptID:     1,
+								URL:          "https://example.com/app.js",
+								LineNumber:   child,
+							},
+						})
+					}
+					stack = append(stack, child)
+				}
+				ids = append(ids, stack[len(stack)-1])
+				deltas = append(deltas, 100+rng.Intn(50))
+			}
+			writeEvent(map[string]any{
+				"name": "ProfileChunk", "cat": "disabled-by-default-v8.cpu_profiler", "ph": "P", "id": id, "pid": pid, "tid": tid + 100, "ts": 1000,
+				"args": map[string]any{"data": map[string]any{
+					"cpuProfile": map[string]any{"nodes": nodes, "samples": ids},
+					"timeDeltas": deltas,
+				}},
+			})
+		}
+	}
+	return out.Bytes()
+}
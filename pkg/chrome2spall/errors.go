@@ -0,0 +1,75 @@
+package chrome2spall
+
+import (
+	"errors"
+	"fmt"
+)
+
+// The problems that Options.Warn is told about. None of them stop the
+// conversion; they're wrapped in a *ParseError or *ProcessError where there's
+// more to say about where they happened.
+var (
+	// ErrNoProfileForPid means that a process's ProfileChunks came without
+	// a Profile event (or, with Options.Streaming, before it), so they were
+	// converted as if the profile started at zero.
+	ErrNoProfileForPid = errors.New("no Profile event")
+
+	// ErrMismatchedChunk means that a ProfileChunk had a different number of
+	// samples and time deltas, and the extras were ignored.
+	ErrMismatchedChunk = errors.New("mismatched ProfileChunk")
+
+	// ErrTruncated means that the input stopped partway through. Everything
+	// up to that point was still converted.
+	ErrTruncated = errors.New("the input ended unexpectedly; it appears to have been truncated")
+
+	// ErrNoMainFrame means that Options.MainOnly was set, but the trace
+	// didn't say which process rendered the main frame.
+	ErrNoMainFrame = errors.New("never saw a TracingStartedInBrowser event, so there's no telling which process is the main renderer; nothing was converted")
+
+	// ErrMarkerNotFound means that the marker named by Options.SinceMarker
+	// or Options.UntilMarker never appeared, so that end of the window was
+	// left open.
+	ErrMarkerNotFound = errors.New("marker not found")
+
+	// ErrNoNames means that the trace named its processes or threads, but
+	// the output format has nowhere to put the names, so they were left out.
+	// Version 1 of spall's binary format can't carry them.
+	ErrNoNames = errors.New("binary output can't name processes or threads")
+)
+
+// ParseError describes an event that couldn't be read, and was left out.
+type ParseError struct {
+	// Line is the line of the input that the event was on, counting from
+	// 1, for traces in Chrome's one-event-per-line format. Otherwise it's 0,
+	// and Offset is the byte offset of the end of the event instead.
+	Line   int
+	Offset int64
+
+	Data []byte // the event, as it was in the input
+	Err  error
+}
+
+func (e *ParseError) Error() string {
+	if e.Line > 0 {
+		return fmt.Sprintf("line %d: %v", e.Line, e.Err)
+	}
+	return fmt.Sprintf("offset %d: %v", e.Offset, e.Err)
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+// ProcessError describes a problem with one process's profile.
+type ProcessError struct {
+	Pid int
+	Err error
+}
+
+func (e *ProcessError) Error() string {
+	return fmt.Sprintf("pid %d: %v", e.Pid, e.Err)
+}
+
+func (e *ProcessError) Unwrap() error {
+	return e.Err
+}
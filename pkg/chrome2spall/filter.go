@@ -0,0 +1,763 @@
+package chrome2spall
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
+)
+
+// minDurationFilter drops frames that are shorter than a minimum duration.
+//
+// We don't know how long a frame is until it ends, so begin events are held
+// back until their matching end arrives. A frame's children always fit
+// inside it, so when a frame is dropped, everything that happened inside it
+// is dropped too; and when a frame survives, all of its ancestors will
+// survive as well, so everything pending can be flushed.
+//
+// Markers are never dropped, but one on a track with begins held back waits
+// behind them, since the binary format needs each track's events in time
+// order.
+type minDurationFilter struct {
+	eventWriter
+	min    float64
+	tracks map[threadID]*pendingTrack
+}
+
+type pendingTrack struct {
+	// pending holds begin events that have not been written yet, because
+	// their frames might still turn out to be too short, and the markers
+	// that came after them.
+	pending []pendingEvent
+
+	// open holds, for each open frame, the index of its begin event in
+	// pending, or -1 if it has already been written.
+	open []int
+}
+
+type pendingEvent struct {
+	Event
+	marker bool
+}
+
+func newMinDurationFilter(next eventWriter, min float64) *minDurationFilter {
+	return &minDurationFilter{
+		eventWriter: next,
+		min:         min,
+		tracks:      make(map[threadID]*pendingTrack),
+	}
+}
+
+func (f *minDurationFilter) track(e Event) *pendingTrack {
+	id := threadID{e.Pid, e.Tid}
+	t, ok := f.tracks[id]
+	if !ok {
+		t = &pendingTrack{}
+		f.tracks[id] = t
+	}
+	return t
+}
+
+func (f *minDurationFilter) writeBeginEvent(e Event) {
+	t := f.track(e)
+	t.open = append(t.open, len(t.pending))
+	t.pending = append(t.pending, pendingEvent{Event: e})
+}
+
+func (f *minDurationFilter) writeMarker(e Event) {
+	t := f.track(e)
+	if len(t.pending) == 0 {
+		f.eventWriter.writeMarker(e)
+		return
+	}
+	t.pending = append(t.pending, pendingEvent{Event: e, marker: true})
+}
+
+func (f *minDurationFilter) writeEndEvent(e Event) {
+	t := f.track(e)
+	if len(t.open) == 0 {
+		// Unbalanced, but that's not our problem to fix.
+		f.eventWriter.writeEndEvent(e)
+		return
+	}
+
+	beginIndex := t.open[len(t.open)-1]
+	t.open = t.open[:len(t.open)-1]
+
+	if beginIndex < 0 {
+		// The begin was already written, because something inside this
+		// frame was long enough to keep.
+		f.eventWriter.writeEndEvent(e)
+		return
+	}
+
+	if e.Time-t.pending[beginIndex].Time < f.min {
+		// Too short; forget this frame and everything inside it. Only
+		// markers can be left after its begin, since its children have
+		// all ended, and they're kept.
+		t.pending = append(t.pending[:beginIndex], t.pending[beginIndex+1:]...)
+		if len(t.open) == 0 || t.open[len(t.open)-1] < 0 {
+			// Nothing is held back anymore, so the markers don't
+			// have to wait.
+			f.flush(t)
+		}
+		return
+	}
+
+	f.flush(t)
+	for i := range t.open {
+		t.open[i] = -1
+	}
+	f.eventWriter.writeEndEvent(e)
+}
+
+// flush writes everything pending on a track, in order.
+func (f *minDurationFilter) flush(t *pendingTrack) {
+	for _, p := range t.pending {
+		if p.marker {
+			f.eventWriter.writeMarker(p.Event)
+		} else {
+			f.eventWriter.writeBeginEvent(p.Event)
+		}
+	}
+	t.pending = t.pending[:0]
+}
+
+// close writes out the markers still waiting behind frames that never
+// ended. Those frames are dropped, since their length is unknown.
+func (f *minDurationFilter) close() error {
+	ids := maps.Keys(f.tracks)
+	slices.SortFunc(ids, threadID.less)
+	for _, id := range ids {
+		for _, p := range f.tracks[id].pending {
+			if p.marker {
+				f.eventWriter.writeMarker(p.Event)
+			}
+		}
+	}
+	return f.eventWriter.close()
+}
+
+// timeWindow is a span of time, relative to the first timestamp read from
+// the trace (which isn't necessarily the earliest), that we want to keep.
+type timeWindow struct {
+	startOffset, endOffset float64
+	noStart                bool // keep everything before the end, too
+	hasEnd                 bool // otherwise, keep everything after the start
+
+	origin     float64
+	haveOrigin bool
+}
+
+// setOrigin records the first timestamp read, if we don't have one yet.
+func (w *timeWindow) setOrigin(t float64) {
+	if !w.haveOrigin {
+		w.origin = t
+		w.haveOrigin = true
+	}
+}
+
+func (w *timeWindow) start() float64 {
+	if w.noStart {
+		return math.Inf(-1)
+	}
+	return w.origin + w.startOffset
+}
+
+func (w *timeWindow) end() float64 {
+	if !w.hasEnd {
+		return math.Inf(1)
+	}
+	return w.origin + w.endOffset
+}
+
+func (w *timeWindow) contains(t float64) bool {
+	return w.start() <= t && t <= w.end()
+}
+
+// windowFilter drops all frames outside a time window. Frames that were
+// already open at the start of the window get a synthetic begin at the
+// start, and frames still open at the end get a synthetic end at the end, so
+// that everything stays balanced.
+type windowFilter struct {
+	eventWriter
+	window *timeWindow
+	tracks map[threadID][]windowFrame
+}
+
+type windowFrame struct {
+	begin   Event
+	written bool
+}
+
+func newWindowFilter(next eventWriter, window *timeWindow) *windowFilter {
+	return &windowFilter{
+		eventWriter: next,
+		window:      window,
+		tracks:      make(map[threadID][]windowFrame),
+	}
+}
+
+// openFrames writes a begin at the start of the window for each frame on the
+// track that began before the window did.
+func (f *windowFilter) openFrames(stack []windowFrame) {
+	for i := range stack {
+		if !stack[i].written && stack[i].begin.Time < f.window.start() {
+			begin := stack[i].begin
+			begin.Time = f.window.start()
+			f.eventWriter.writeBeginEvent(begin)
+			stack[i].written = true
+		}
+	}
+}
+
+func (f *windowFilter) writeBeginEvent(e Event) {
+	id := threadID{e.Pid, e.Tid}
+	stack := f.tracks[id]
+
+	written := false
+	if f.window.contains(e.Time) {
+		f.openFrames(stack)
+		f.eventWriter.writeBeginEvent(e)
+		written = true
+	}
+	f.tracks[id] = append(stack, windowFrame{begin: e, written: written})
+}
+
+func (f *windowFilter) writeEndEvent(e Event) {
+	id := threadID{e.Pid, e.Tid}
+	stack := f.tracks[id]
+	if len(stack) == 0 {
+		return
+	}
+
+	if e.Time >= f.window.start() {
+		f.openFrames(stack)
+	}
+	if stack[len(stack)-1].written {
+		e.Time = min(e.Time, f.window.end())
+		f.eventWriter.writeEndEvent(e)
+	}
+	f.tracks[id] = stack[:len(stack)-1]
+}
+
+func (f *windowFilter) writeMarker(e Event) {
+	if f.window.contains(e.Time) {
+		f.eventWriter.writeMarker(e)
+	}
+}
+
+// rebaseFilter shifts every timestamp so that the earliest one written is at
+// zero, which keeps spall's ruler readable and float precision high. The
+// earliest isn't known until the end, so everything is held until then,
+// unless streaming. Then the first timestamp written is taken as zero, and
+// anything earlier that comes after it is clamped to zero.
+type rebaseFilter struct {
+	eventWriter
+	streaming  bool
+	origin     float64
+	haveOrigin bool
+	calls      []func()
+}
+
+func newRebaseFilter(next eventWriter, streaming bool) *rebaseFilter {
+	return &rebaseFilter{eventWriter: next, streaming: streaming}
+}
+
+// write calls write with t rebased, now or at the end.
+func (f *rebaseFilter) write(t float64, write func(t float64)) {
+	if !f.haveOrigin || (!f.streaming && t < f.origin) {
+		f.origin = t
+		f.haveOrigin = true
+	}
+	if f.streaming {
+		write(max(t-f.origin, 0))
+		return
+	}
+	f.calls = append(f.calls, func() { write(t - f.origin) })
+}
+
+// writeUntimed passes on an event without a timestamp, in its place among
+// the others.
+func (f *rebaseFilter) writeUntimed(write func()) {
+	if f.streaming {
+		write()
+		return
+	}
+	f.calls = append(f.calls, write)
+}
+
+func (f *rebaseFilter) writeBeginEvent(e Event) {
+	f.write(e.Time, func(t float64) {
+		e.Time = t
+		f.eventWriter.writeBeginEvent(e)
+	})
+}
+
+func (f *rebaseFilter) writeEndEvent(e Event) {
+	f.write(e.Time, func(t float64) {
+		e.Time = t
+		f.eventWriter.writeEndEvent(e)
+	})
+}
+
+func (f *rebaseFilter) writeMarker(e Event) {
+	f.write(e.Time, func(t float64) {
+		e.Time = t
+		f.eventWriter.writeMarker(e)
+	})
+}
+
+func (f *rebaseFilter) writeProcessName(pid int, name string) {
+	f.writeUntimed(func() { f.eventWriter.writeProcessName(pid, name) })
+}
+
+func (f *rebaseFilter) writeThreadName(pid, tid int, name string) {
+	f.writeUntimed(func() { f.eventWriter.writeThreadName(pid, tid, name) })
+}
+
+func (f *rebaseFilter) writePassThrough(line string) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(line), &fields); err != nil {
+		f.writeUntimed(func() { f.eventWriter.writePassThrough(line) })
+		return
+	}
+
+	// Metadata events don't have meaningful timestamps, so leave them be.
+	var ts float64
+	if string(fields["ph"]) == `"M"` || json.Unmarshal(fields["ts"], &ts) != nil {
+		f.writeUntimed(func() { f.eventWriter.writePassThrough(line) })
+		return
+	}
+	f.write(ts, func(t float64) {
+		fields["ts"] = must1(json.Marshal(t))
+		f.eventWriter.writePassThrough(string(must1(json.Marshal(fields))))
+	})
+}
+
+func (f *rebaseFilter) close() error {
+	for _, call := range f.calls {
+		call()
+	}
+	f.calls = nil
+	return f.eventWriter.close()
+}
+
+// remapFilter renames pids and tids on the way out, so that the output can
+// sit alongside other spall data without its tracks colliding. Anything not
+// in the maps is left alone.
+type remapFilter struct {
+	eventWriter
+	pids, tids map[int]int
+}
+
+func (f *remapFilter) pid(pid int) int {
+	if to, ok := f.pids[pid]; ok {
+		return to
+	}
+	return pid
+}
+
+func (f *remapFilter) tid(tid int) int {
+	if to, ok := f.tids[tid]; ok {
+		return to
+	}
+	return tid
+}
+
+func (f *remapFilter) writeBeginEvent(e Event) {
+	e.Pid, e.Tid = f.pid(e.Pid), f.tid(e.Tid)
+	f.eventWriter.writeBeginEvent(e)
+}
+
+func (f *remapFilter) writeEndEvent(e Event) {
+	e.Pid, e.Tid = f.pid(e.Pid), f.tid(e.Tid)
+	f.eventWriter.writeEndEvent(e)
+}
+
+func (f *remapFilter) writeMarker(e Event) {
+	e.Pid, e.Tid = f.pid(e.Pid), f.tid(e.Tid)
+	f.eventWriter.writeMarker(e)
+}
+
+func (f *remapFilter) writeProcessName(pid int, name string) {
+	f.eventWriter.writeProcessName(f.pid(pid), name)
+}
+
+func (f *remapFilter) writeThreadName(pid, tid int, name string) {
+	f.eventWriter.writeThreadName(f.pid(pid), f.tid(tid), name)
+}
+
+func (f *remapFilter) writePassThrough(line string) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(line), &fields); err != nil {
+		f.eventWriter.writePassThrough(line)
+		return
+	}
+
+	changed := false
+	var id int
+	if json.Unmarshal(fields["pid"], &id) == nil && f.pid(id) != id {
+		fields["pid"] = must1(json.Marshal(f.pid(id)))
+		changed = true
+	}
+	if json.Unmarshal(fields["tid"], &id) == nil && f.tid(id) != id {
+		fields["tid"] = must1(json.Marshal(f.tid(id)))
+		changed = true
+	}
+	if !changed {
+		f.eventWriter.writePassThrough(line)
+		return
+	}
+	f.eventWriter.writePassThrough(string(must1(json.Marshal(fields))))
+}
+
+// maxEventsFilter stops writing frames once a limit of begin and end events
+// has been reached. Whatever is still open at that point is ended on close,
+// at the last time written on its thread, so the output stays balanced; those
+// ends are the only events that go over the limit. The whole input's time
+// span is recorded in the stats, to show how much of it made it out.
+type maxEventsFilter struct {
+	eventWriter
+	max, written int
+	stats        *Stats
+	seen         bool
+
+	tracks   map[threadID][]Event // the begins written for each open frame
+	lastTime map[threadID]float64
+}
+
+func newMaxEventsFilter(next eventWriter, limit int, stats *Stats) *maxEventsFilter {
+	return &maxEventsFilter{
+		eventWriter: next,
+		max:         limit,
+		stats:       stats,
+		tracks:      make(map[threadID][]Event),
+		lastTime:    make(map[threadID]float64),
+	}
+}
+
+// see records t in the input's time span, and reports whether there's still
+// room for another event.
+func (f *maxEventsFilter) see(t float64) bool {
+	if !f.seen {
+		f.stats.InputFirstTime, f.stats.InputLastTime = t, t
+		f.seen = true
+	}
+	f.stats.InputFirstTime = min(f.stats.InputFirstTime, t)
+	f.stats.InputLastTime = max(f.stats.InputLastTime, t)
+	if f.written >= f.max {
+		f.stats.EventLimitReached = true
+		return false
+	}
+	return true
+}
+
+func (f *maxEventsFilter) writeBeginEvent(e Event) {
+	if !f.see(e.Time) {
+		return
+	}
+	id := threadID{e.Pid, e.Tid}
+	f.tracks[id] = append(f.tracks[id], e)
+	f.lastTime[id] = e.Time
+	f.written++
+	f.eventWriter.writeBeginEvent(e)
+}
+
+func (f *maxEventsFilter) writeEndEvent(e Event) {
+	if !f.see(e.Time) {
+		return
+	}
+	id := threadID{e.Pid, e.Tid}
+	if stack := f.tracks[id]; len(stack) > 0 {
+		f.tracks[id] = stack[:len(stack)-1]
+	}
+	f.lastTime[id] = e.Time
+	f.written++
+	f.eventWriter.writeEndEvent(e)
+}
+
+func (f *maxEventsFilter) writeMarker(e Event) {
+	if f.see(e.Time) {
+		f.eventWriter.writeMarker(e)
+	}
+}
+
+func (f *maxEventsFilter) close() error {
+	ids := maps.Keys(f.tracks)
+	slices.SortFunc(ids, threadID.less)
+	for _, id := range ids {
+		stack := f.tracks[id]
+		for i := len(stack) - 1; i >= 0; i-- {
+			f.eventWriter.writeEndEvent(Event{
+				Category: stack[i].Category,
+				Type:     "E",
+				Pid:      id.Pid,
+				Tid:      id.Tid,
+				Time:     f.lastTime[id],
+			})
+		}
+	}
+	return f.eventWriter.close()
+}
+
+// markerFilter sets the time window from the markers named by
+// Options.SinceMarker and Options.UntilMarker. The markers could turn up
+// anywhere in the input, so everything is held until the end, when the
+// window is known; then it's all written out through a windowFilter.
+type markerFilter struct {
+	eventWriter
+	window       *timeWindow
+	since, until string
+	warn         func(err error)
+
+	calls              []func()
+	sinceTimes, untils []float64
+	first              float64
+	seen               bool
+}
+
+func newMarkerFilter(next eventWriter, window *timeWindow, since, until string, warn func(err error)) *markerFilter {
+	return &markerFilter{
+		eventWriter: next,
+		window:      window,
+		since:       since,
+		until:       until,
+		warn:        warn,
+	}
+}
+
+func (f *markerFilter) see(t float64) {
+	if !f.seen {
+		f.first = t
+		f.seen = true
+	}
+	f.first = min(f.first, t)
+}
+
+func (f *markerFilter) writeBeginEvent(e Event) {
+	f.see(e.Time)
+	f.calls = append(f.calls, func() { f.eventWriter.writeBeginEvent(e) })
+}
+
+func (f *markerFilter) writeEndEvent(e Event) {
+	f.see(e.Time)
+	f.calls = append(f.calls, func() { f.eventWriter.writeEndEvent(e) })
+}
+
+func (f *markerFilter) writeMarker(e Event) {
+	f.see(e.Time)
+	if f.since != "" && e.Name == f.since {
+		f.sinceTimes = append(f.sinceTimes, e.Time)
+	}
+	if f.until != "" && e.Name == f.until {
+		f.untils = append(f.untils, e.Time)
+	}
+	f.calls = append(f.calls, func() { f.eventWriter.writeMarker(e) })
+}
+
+func (f *markerFilter) writeProcessName(pid int, name string) {
+	f.calls = append(f.calls, func() { f.eventWriter.writeProcessName(pid, name) })
+}
+
+func (f *markerFilter) writeThreadName(pid, tid int, name string) {
+	f.calls = append(f.calls, func() { f.eventWriter.writeThreadName(pid, tid, name) })
+}
+
+func (f *markerFilter) writePassThrough(line string) {
+	f.calls = append(f.calls, func() {
+		if f.passThroughInWindow(line) {
+			f.eventWriter.writePassThrough(line)
+		}
+	})
+}
+
+// passThroughInWindow reports whether an event that's passed through is in
+// the window, the same as the Converter checks for --start and --end.
+func (f *markerFilter) passThroughInWindow(line string) bool {
+	var e struct {
+		Type string   `json:"ph"`
+		Time *float64 `json:"ts"`
+	}
+	if json.Unmarshal([]byte(line), &e) != nil || e.Type == "M" || e.Time == nil {
+		return true
+	}
+	return f.window.contains(*e.Time)
+}
+
+// setWindow works out the window from the markers, leaving either end open
+// if there's no marker for it.
+func (f *markerFilter) setWindow() {
+	f.window.setOrigin(f.first)
+	f.window.noStart = true
+	start := math.Inf(-1)
+	if f.since != "" {
+		if len(f.sinceTimes) == 0 {
+			f.warnf("%w: no marker named %q, so starting from the beginning of the trace", ErrMarkerNotFound, f.since)
+		} else {
+			start = f.sinceTimes[0]
+			for _, t := range f.sinceTimes {
+				start = min(start, t)
+			}
+			f.window.noStart = false
+			f.window.startOffset = start - f.first
+		}
+	}
+	if f.until != "" {
+		end := math.Inf(1)
+		for _, t := range f.untils {
+			if t > start {
+				end = min(end, t)
+			}
+		}
+		if math.IsInf(end, 1) {
+			f.warnf("%w: no marker named %q after the start, so going to the end of the trace", ErrMarkerNotFound, f.until)
+		} else {
+			f.window.endOffset = end - f.first
+			f.window.hasEnd = true
+		}
+	}
+}
+
+func (f *markerFilter) warnf(format string, args ...any) {
+	if f.warn != nil {
+		f.warn(fmt.Errorf(format, args...))
+	}
+}
+
+func (f *markerFilter) close() error {
+	f.setWindow()
+	for _, call := range f.calls {
+		call()
+	}
+	f.calls = nil
+	return f.eventWriter.close()
+}
+
+// mergeThreadsFilter puts all of a process's threads on one track, the
+// process's lowest tid, so that everything it ran can be seen in one place.
+// Each frame's name gets the tid it came from.
+//
+// Two threads can run at once, so their frames overlap without nesting. The
+// frames are interleaved by time on a single stack, and when a frame ends
+// underneath another thread's frames, those are ended with it and begun
+// again straight after. That keeps every begin and end matched, at the cost
+// of splitting frames that overlapped into several pieces.
+//
+// Frames come out one profile at a time, so they're all held until the end
+// to be put in time order.
+type mergeThreadsFilter struct {
+	eventWriter
+	events map[int][]mergedEvent // by pid
+}
+
+// mergedEvent is a begin, an end, or a marker (Type "I") held for merging.
+// Every kind is kept in one list, in the order it arrived, so that a
+// thread's events stay in order when they're sorted by time.
+type mergedEvent struct {
+	Event
+	Order int
+}
+
+func newMergeThreadsFilter(next eventWriter) *mergeThreadsFilter {
+	return &mergeThreadsFilter{
+		eventWriter: next,
+		events:      make(map[int][]mergedEvent),
+	}
+}
+
+func (f *mergeThreadsFilter) hold(e Event) {
+	events := f.events[e.Pid]
+	f.events[e.Pid] = append(events, mergedEvent{e, len(events)})
+}
+
+func (f *mergeThreadsFilter) writeBeginEvent(e Event) {
+	e.Type = "B"
+	f.hold(e)
+}
+
+func (f *mergeThreadsFilter) writeEndEvent(e Event) {
+	e.Type = "E"
+	f.hold(e)
+}
+
+func (f *mergeThreadsFilter) writeMarker(e Event) {
+	e.Type = "I"
+	f.hold(e)
+}
+
+// writeThreadName names the merged track instead, once per process.
+func (f *mergeThreadsFilter) writeThreadName(pid, tid int, name string) {}
+
+func (f *mergeThreadsFilter) close() error {
+	pids := maps.Keys(f.events)
+	slices.Sort(pids)
+	for _, pid := range pids {
+		f.writeProcess(pid, f.events[pid])
+	}
+	f.events = nil
+	return f.eventWriter.close()
+}
+
+func (f *mergeThreadsFilter) writeProcess(pid int, events []mergedEvent) {
+	slices.SortFunc(events, func(a, b mergedEvent) bool {
+		if a.Time != b.Time {
+			return a.Time < b.Time
+		}
+		return a.Order < b.Order
+	})
+	lane := events[0].Tid
+	for _, e := range events {
+		lane = min(lane, e.Tid)
+	}
+	f.eventWriter.writeThreadName(pid, lane, "All threads")
+
+	var stack []Event // the begins of the open frames, as they came in
+	for _, e := range events {
+		out := e.Event
+		out.Tid = lane
+		switch e.Type {
+		case "B":
+			stack = append(stack, e.Event)
+			out.Name = fmt.Sprintf("%s [tid %d]", e.Name, e.Tid)
+			f.eventWriter.writeBeginEvent(out)
+		case "I":
+			out.Name = fmt.Sprintf("%s [tid %d]", e.Name, e.Tid)
+			f.eventWriter.writeMarker(out)
+		case "E":
+			// Find this thread's innermost frame.
+			i := len(stack) - 1
+			for i >= 0 && stack[i].Tid != e.Tid {
+				i--
+			}
+			if i < 0 {
+				// Unbalanced, but that's not our problem to fix.
+				f.eventWriter.writeEndEvent(out)
+				continue
+			}
+
+			// End the other threads' frames that are in the way, then
+			// this one, then begin the others again.
+			above := stack[i+1:]
+			for j := len(above) - 1; j >= 0; j-- {
+				f.eventWriter.writeEndEvent(Event{
+					Category: above[j].Category,
+					Type:     "E",
+					Pid:      pid,
+					Tid:      lane,
+					Time:     e.Time,
+				})
+			}
+			f.eventWriter.writeEndEvent(out)
+			for _, begin := range above {
+				begin.Name = fmt.Sprintf("%s [tid %d]", begin.Name, begin.Tid)
+				begin.Tid = lane
+				begin.Time = e.Time
+				f.eventWriter.writeBeginEvent(begin)
+			}
+			stack = append(stack[:i], above...)
+		}
+	}
+}
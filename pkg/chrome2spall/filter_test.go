@@ -0,0 +1,257 @@
+package chrome2spall
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRebaseZero(t *testing.T) {
+	// The first marker is read before the frames, but comes after the
+	// first of them.
+	input := filepath.Join("testdata", "markers.json")
+	tests := []struct {
+		name      string
+		streaming bool
+		want      map[string]float64 // the time each named begin ends up at
+	}{
+		{"buffered", false, map[string]float64{"main": 0, "before": 139, "step": 100, "after": 239}},
+		{"streaming", true, map[string]float64{"before": 0, "main": 0, "step": 0, "after": 100}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			out := convertFile(t, input, Options{RebaseZero: true, Streaming: test.streaming})
+			for _, e := range jsonEvents(t, out) {
+				if e.Ph != "B" {
+					continue
+				}
+				if want, ok := test.want[e.Name]; !ok || e.Ts != want {
+					t.Errorf("%s begins at %v, want %v", e.Name, e.Ts, want)
+				}
+			}
+		})
+	}
+}
+
+func TestMarkerWindow(t *testing.T) {
+	in, err := os.ReadFile(filepath.Join("testdata", "markers.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// An event that's passed through, from before any frame or marker, and
+	// a marker at the same time as the first frame.
+	in = append(in, `{"args":{},"cat":"toplevel","dur":10,"name":"Early","ph":"X","pid":10,"tid":20,"ts":1000},`+"\n"...)
+	in = append(in, `{"args":{"data":{"message":"first"}},"cat":"devtools.timeline","name":"TimeStamp","ph":"I","pid":10,"s":"t","tid":20,"ts":1111},`+"\n"...)
+
+	tests := []struct {
+		name         string
+		since, until string
+		want         []string // each begin or complete event, and when
+		warnings     int
+	}{
+		{"until only", "", "after", []string{"before 1250", "main 1111", "step 1211", "after 1350", "Early 1000", "first 1111"}, 0},
+		{"since only", "before", "", []string{"before 1250", "main 1250", "step 1250", "after 1350"}, 0},
+		{"both", "before", "after", []string{"before 1250", "main 1250", "step 1250", "after 1350"}, 0},
+		{"since missing", "nope", "after", []string{"before 1250", "main 1111", "step 1211", "after 1350", "Early 1000", "first 1111"}, 1},
+		{"until missing", "", "nope", []string{"before 1250", "main 1111", "step 1211", "after 1350", "Early 1000", "first 1111"}, 1},
+		{"until at the first event", "", "first", []string{"main 1111", "Early 1000", "first 1111"}, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var out bytes.Buffer
+			warnings := 0
+			opts := Options{
+				SinceMarker: test.since,
+				UntilMarker: test.until,
+				Warn:        func(err error) { warnings++ },
+			}
+			if _, err := Convert(bytes.NewReader(in), &out, opts); err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, e := range jsonEvents(t, out.Bytes()) {
+				if e.Ph == "B" || e.Ph == "X" {
+					got = append(got, fmt.Sprintf("%s %v", e.Name, e.Ts))
+				}
+			}
+			if strings.Join(got, ", ") != strings.Join(test.want, ", ") {
+				t.Errorf("got %s, want %s", strings.Join(got, ", "), strings.Join(test.want, ", "))
+			}
+			if warnings != test.warnings {
+				t.Errorf("got %d warnings, want %d", warnings, test.warnings)
+			}
+		})
+	}
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += n
+	return n, err
+}
+
+func TestMaxEvents(t *testing.T) {
+	trace := generateTrace(4, 5000)
+	tests := []struct {
+		name   string
+		opts   Options
+		unread bool // whether the rest of the input should go unread
+	}{
+		{"serial", Options{MaxEvents: 10}, true},
+		{"jobs", Options{MaxEvents: 10, Jobs: 2}, false},
+		{"binary", Options{MaxEvents: 10, Format: "binary"}, false},
+		{"streaming binary", Options{MaxEvents: 10, Format: "binary", Streaming: true}, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := &countingReader{r: bytes.NewReader(trace)}
+			var out bytes.Buffer
+			stats, err := Convert(r, &out, test.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !stats.EventLimitReached {
+				t.Error("EventLimitReached isn't set")
+			}
+			if stats.InputUnread != test.unread {
+				t.Errorf("InputUnread is %v, want %v", stats.InputUnread, test.unread)
+			}
+			if read := r.n < len(trace); read != test.unread {
+				t.Errorf("read %d bytes of %d", r.n, len(trace))
+			}
+			// The cut off frames are still ended.
+			if stats.BeginEvents > 10 || stats.BeginEvents != stats.EndEvents {
+				t.Errorf("wrote %d begins and %d ends", stats.BeginEvents, stats.EndEvents)
+			}
+			format := test.opts.Format
+			if format == "" {
+				format = "json"
+			}
+			if err := Validate(&out, format); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestTimeWindow(t *testing.T) {
+	in, err := os.ReadFile(filepath.Join("testdata", "markers.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A marker from before the Profile event, which starts the trace, but
+	// after it in the input.
+	in = append(in, `{"args":{"data":{"message":"late"}},"cat":"devtools.timeline","name":"TimeStamp","ph":"I","pid":10,"s":"t","tid":20,"ts":900},`+"\n"...)
+
+	tests := []struct {
+		name       string
+		start, end time.Duration
+		want       []string // each begin, and when
+	}{
+		// The window is measured from the first event, not the earliest,
+		// which falls outside it.
+		{"start", 150 * time.Microsecond, 0, []string{"before 1250", "main 1150", "step 1211", "after 1350"}},
+		{"end", 0, 300 * time.Microsecond, []string{"before 1250", "main 1111", "step 1211"}},
+		{"both", 220 * time.Microsecond, 300 * time.Microsecond, []string{"before 1250", "main 1220", "step 1220"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			out := convertBytes(t, in, Options{Start: test.start, End: test.end})
+			var got []string
+			for _, e := range jsonEvents(t, out) {
+				if e.Ph == "B" {
+					got = append(got, fmt.Sprintf("%s %v", e.Name, e.Ts))
+				}
+			}
+			if strings.Join(got, ", ") != strings.Join(test.want, ", ") {
+				t.Errorf("got %s, want %s", strings.Join(got, ", "), strings.Join(test.want, ", "))
+			}
+			if err := Validate(bytes.NewReader(out), "json"); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestMergeThreads(t *testing.T) {
+	// The nested profile again, on a second thread of the same process and
+	// starting 150us later, so the two threads' frames overlap.
+	in, err := os.ReadFile(filepath.Join("testdata", "nested.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	trace := string(in)
+	for _, line := range strings.Split(string(in), "\n") {
+		if !strings.Contains(line, `"name":"Profile`) {
+			continue
+		}
+		line = strings.Trim(line, "[],")
+		line = strings.Replace(line, `"tid":20`, `"tid":21`, 1)
+		line = strings.Replace(line, `"id":"0x1"`, `"id":"0x2"`, 1)
+		line = strings.Replace(line, `"startTime":1000`, `"startTime":1150`, 1)
+		trace += line + ",\n"
+	}
+
+	out := convertBytes(t, []byte(trace), Options{MergeThreads: true})
+	if err := Validate(bytes.NewReader(out), "json"); err != nil {
+		t.Error(err)
+	}
+	frames := make(map[string]int)
+	last := 0.0
+	for _, e := range jsonEvents(t, out) {
+		if e.Cat != "function" {
+			continue
+		}
+		if e.Tid != 20 {
+			t.Errorf("%s %s is on tid %d, want 20", e.Ph, e.Name, e.Tid)
+		}
+		if e.Ts < last {
+			t.Errorf("%s %s at %v comes after %v", e.Ph, e.Name, e.Ts, last)
+		}
+		last = e.Ts
+		if e.Ph == "B" {
+			frames[e.Name]++
+		}
+	}
+	for _, name := range []string{"main", "render", "layout", "paint"} {
+		for _, tid := range []int{20, 21} {
+			if name := fmt.Sprintf("%s [tid %d]", name, tid); frames[name] == 0 {
+				t.Errorf("no frame named %q", name)
+			}
+		}
+	}
+}
+
+// TestMinDurationMarkers writes binary output, which has to be in time order
+// on each thread, with frames held back by MinDuration around the markers.
+// The markers keep their place whether the frames around them are kept or
+// not.
+func TestMinDurationMarkers(t *testing.T) {
+	tests := []struct {
+		min  time.Duration
+		want []string
+	}{
+		{time.Microsecond, []string{"B main 1111", "B step 1211", "B before 1250", "E 1250", "B after 1350", "E 1350", "E 1409", "E 1509"}},
+		{250 * time.Microsecond, []string{"B main 1111", "B before 1250", "E 1250", "B after 1350", "E 1350", "E 1509"}},
+		{time.Second, []string{"B before 1250", "E 1250", "B after 1350", "E 1350"}},
+	}
+	for _, test := range tests {
+		t.Run(test.min.String(), func(t *testing.T) {
+			out := convertFile(t, filepath.Join("testdata", "markers.json"), Options{Format: "binary", MinDuration: test.min})
+			if got := binaryEvents(t, out); strings.Join(got, "\n") != strings.Join(test.want, "\n") {
+				t.Errorf("got events:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(test.want, "\n"))
+			}
+		})
+	}
+}
@@ -0,0 +1,510 @@
+package chrome2spall
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"unicode/utf8"
+
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
+)
+
+// An eventWriter serializes converted events in some output format.
+type eventWriter interface {
+	writeBeginEvent(e Event)
+	writeEndEvent(e Event)
+
+	// writeMarker emits an instantaneous event, like a console.timeStamp.
+	// These are written as zero-length frames, which every spall importer
+	// can display.
+	writeMarker(e Event)
+
+	writeProcessName(pid int, name string)
+	writeThreadName(pid, tid int, name string)
+
+	// writePassThrough emits a trace event that we didn't convert. Formats
+	// that can't represent arbitrary trace events may drop it.
+	writePassThrough(line string)
+
+	// close finishes the output stream and reports the first error that
+	// occurred while writing, if any.
+	close() error
+}
+
+// newEventWriter creates a writer for the format named in opts. Options like
+// Pretty only apply to the formats where they mean anything.
+func newEventWriter(w io.Writer, opts Options) (eventWriter, error) {
+	switch format := opts.Format; format {
+	case "json":
+		jw := newJSONWriter(w, opts)
+		if opts.CompleteEvents {
+			return newCompleteWriter(jw), nil
+		}
+		return jw, nil
+	case "binary":
+		return newBinaryWriter(w, opts.Append, opts.Warn), nil
+	case "perfetto":
+		return newPerfettoWriter(w), nil
+	default:
+		return nil, fmt.Errorf("unknown output format %q (expected json, binary, or perfetto)", format)
+	}
+}
+
+// jsonWriter emits Chrome trace-event JSON, one event per line, in the
+// lenient comma-terminated form that spall's JSON importer accepts.
+type jsonWriter struct {
+	w   io.Writer
+	buf []byte
+	err error
+
+	// pretty indents each event, for people reading the output rather than
+	// spall. Events then span several lines, but are still each followed by
+	// a comma and a newline.
+	pretty   bool
+	indented bytes.Buffer
+
+	// wrap writes a strictly valid JSON document instead, with the events
+	// in a traceEvents array. Then the commas have to go between events
+	// rather than after them, and started tracks whether one is needed.
+	// displayUnit goes in the document's displayTimeUnit.
+	wrap        bool
+	started     bool
+	displayUnit string
+}
+
+func newJSONWriter(w io.Writer, opts Options) *jsonWriter {
+	jw := &jsonWriter{w: w, pretty: opts.Pretty, wrap: opts.Wrap, displayUnit: opts.DisplayUnit}
+	if opts.Append {
+		// The events already there need a comma after them.
+		jw.started = jw.wrap
+	} else if jw.wrap {
+		jw.printf("{\"traceEvents\":[\n")
+	} else {
+		jw.printf("[\n")
+	}
+	return jw
+}
+
+func (jw *jsonWriter) printf(format string, a ...any) {
+	if jw.err != nil {
+		return
+	}
+	_, jw.err = fmt.Fprintf(jw.w, format, a...)
+}
+
+func (jw *jsonWriter) write(b []byte) {
+	if jw.err != nil {
+		return
+	}
+	_, jw.err = jw.w.Write(b)
+}
+
+// writeLine writes a single serialized event, followed by the trailing comma
+// and newline.
+func (jw *jsonWriter) writeLine(b []byte) {
+	if jw.pretty {
+		jw.indented.Reset()
+		must0(json.Indent(&jw.indented, b, "", "  "))
+		b = jw.indented.Bytes()
+	}
+	if jw.wrap {
+		if jw.started {
+			jw.write([]byte(",\n"))
+		}
+		jw.write(b)
+		jw.started = true
+		return
+	}
+	jw.write(b)
+	jw.write([]byte(",\n"))
+}
+
+func (jw *jsonWriter) writeBeginEvent(e Event) {
+	jw.writeEvent(e)
+}
+
+func (jw *jsonWriter) writeEndEvent(e Event) {
+	jw.writeEvent(e)
+}
+
+func (jw *jsonWriter) writeMarker(e Event) {
+	e.Type = "B"
+	jw.writeEvent(e)
+	jw.writeEvent(Event{Category: e.Category, Type: "E", Pid: e.Pid, Tid: e.Tid, Time: e.Time})
+}
+
+// writeEvent serializes an event by hand, since json.Marshal is by far the
+// most expensive part of converting large profiles. The output is identical
+// to what json.Marshal would produce.
+func (jw *jsonWriter) writeEvent(e Event) {
+	b := jw.buf[:0]
+	b = append(b, `{"name":`...)
+	b = appendJSONString(b, e.Name)
+	b = append(b, `,"cat":`...)
+	b = appendJSONString(b, e.Category)
+	b = append(b, `,"ph":`...)
+	b = appendJSONString(b, e.Type)
+	b = append(b, `,"ts":`...)
+	b = appendJSONFloat(b, e.Time)
+	if e.Type == "X" {
+		b = append(b, `,"dur":`...)
+		b = appendJSONFloat(b, e.Duration)
+	}
+	b = append(b, `,"pid":`...)
+	b = strconv.AppendInt(b, int64(e.Pid), 10)
+	b = append(b, `,"tid":`...)
+	b = strconv.AppendInt(b, int64(e.Tid), 10)
+	b = append(b, `,"args":`...)
+	if e.Args == nil {
+		b = append(b, "null"...)
+	} else {
+		var args bytes.Buffer
+		must0(json.Compact(&args, e.Args))
+		var escaped bytes.Buffer
+		json.HTMLEscape(&escaped, args.Bytes())
+		b = append(b, escaped.Bytes()...)
+	}
+	if e.Color != "" {
+		b = append(b, `,"cname":`...)
+		b = appendJSONString(b, e.Color)
+	}
+	b = append(b, '}')
+	jw.writeLine(b)
+	jw.buf = b
+}
+
+// appendJSONFloat appends f formatted the way encoding/json formats a
+// float64.
+func appendJSONFloat(b []byte, f float64) []byte {
+	abs := math.Abs(f)
+	fmt := byte('f')
+	if abs != 0 && (abs < 1e-6 || abs >= 1e21) {
+		fmt = 'e'
+	}
+	b = strconv.AppendFloat(b, f, fmt, -1, 64)
+	if fmt == 'e' {
+		// clean up e-09 to e-9
+		n := len(b)
+		if n >= 4 && b[n-4] == 'e' && b[n-3] == '-' && b[n-2] == '0' {
+			b[n-2] = b[n-1]
+			b = b[:n-1]
+		}
+	}
+	return b
+}
+
+// appendJSONString appends s as a quoted JSON string, escaped exactly the way
+// encoding/json does it (including its HTML-safe escaping).
+func appendJSONString(b []byte, s string) []byte {
+	const hex = "0123456789abcdef"
+
+	b = append(b, '"')
+	start := 0
+	for i := 0; i < len(s); {
+		if c := s[i]; c < utf8.RuneSelf {
+			if c >= 0x20 && c != '"' && c != '\\' && c != '<' && c != '>' && c != '&' {
+				i++
+				continue
+			}
+			b = append(b, s[start:i]...)
+			switch c {
+			case '\\', '"':
+				b = append(b, '\\', c)
+			case '\b':
+				b = append(b, '\\', 'b')
+			case '\f':
+				b = append(b, '\\', 'f')
+			case '\n':
+				b = append(b, '\\', 'n')
+			case '\r':
+				b = append(b, '\\', 'r')
+			case '\t':
+				b = append(b, '\\', 't')
+			default:
+				b = append(b, '\\', 'u', '0', '0', hex[c>>4], hex[c&0xF])
+			}
+			i++
+			start = i
+			continue
+		}
+
+		r, size := utf8.DecodeRuneInString(s[i:])
+		if r == utf8.RuneError && size == 1 {
+			b = append(b, s[start:i]...)
+			b = append(b, string(utf8.RuneError)...)
+			i += size
+			start = i
+			continue
+		}
+		if r == '\u2028' || r == '\u2029' {
+			b = append(b, s[start:i]...)
+			b = append(b, '\\', 'u', '2', '0', '2', hex[r&0xF])
+			i += size
+			start = i
+			continue
+		}
+		i += size
+	}
+	b = append(b, s[start:]...)
+	b = append(b, '"')
+	return b
+}
+
+// metadataEvent is the minimal shape of the process_name and thread_name
+// events that name tracks in spall.
+type metadataEvent struct {
+	Name string   `json:"name"`
+	Type string   `json:"ph"`
+	Pid  int      `json:"pid"`
+	Tid  int      `json:"tid"`
+	Args NameArgs `json:"args"`
+}
+
+func (jw *jsonWriter) writeProcessName(pid int, name string) {
+	e := metadataEvent{Name: "process_name", Type: "M", Pid: pid, Args: NameArgs{name}}
+	jw.writeLine(must1(json.Marshal(e)))
+}
+
+func (jw *jsonWriter) writeThreadName(pid, tid int, name string) {
+	e := metadataEvent{Name: "thread_name", Type: "M", Pid: pid, Tid: tid, Args: NameArgs{name}}
+	jw.writeLine(must1(json.Marshal(e)))
+}
+
+func (jw *jsonWriter) writePassThrough(line string) {
+	jw.writeLine([]byte(line))
+}
+
+func (jw *jsonWriter) close() error {
+	if jw.wrap {
+		if jw.started {
+			jw.printf("\n")
+		}
+		jw.printf("],\"displayTimeUnit\":%q}\n", jw.displayUnit)
+	} else {
+		jw.printf("]\n")
+	}
+	return jw.err
+}
+
+// completeWriter writes each frame as a single complete (X) event, instead
+// of a begin and an end, which halves the size of the output. Begins are
+// held until their frame ends and its duration is known.
+type completeWriter struct {
+	*jsonWriter
+	tracks map[threadID][]Event
+}
+
+func newCompleteWriter(jw *jsonWriter) *completeWriter {
+	return &completeWriter{jsonWriter: jw, tracks: make(map[threadID][]Event)}
+}
+
+func (cw *completeWriter) writeBeginEvent(e Event) {
+	id := threadID{e.Pid, e.Tid}
+	cw.tracks[id] = append(cw.tracks[id], e)
+}
+
+func (cw *completeWriter) writeEndEvent(e Event) {
+	id := threadID{e.Pid, e.Tid}
+	stack := cw.tracks[id]
+	if len(stack) == 0 {
+		// Unbalanced, but that's not our problem to fix.
+		cw.jsonWriter.writeEndEvent(e)
+		return
+	}
+	begin := stack[len(stack)-1]
+	cw.tracks[id] = stack[:len(stack)-1]
+
+	begin.Type = "X"
+	begin.Duration = e.Time - begin.Time
+	begin.Args = mergeArgs(begin.Args, e.Args)
+	cw.writeEvent(begin)
+}
+
+func (cw *completeWriter) writeMarker(e Event) {
+	e.Type = "X"
+	e.Duration = 0
+	cw.writeEvent(e)
+}
+
+func (cw *completeWriter) close() error {
+	// Anything still open never ended, so it can only be written as a
+	// begin.
+	ids := maps.Keys(cw.tracks)
+	slices.SortFunc(ids, threadID.less)
+	for _, id := range ids {
+		for _, begin := range cw.tracks[id] {
+			cw.jsonWriter.writeBeginEvent(begin)
+		}
+	}
+	return cw.jsonWriter.close()
+}
+
+// mergeArgs combines the args of a begin and its end, the way viewers do.
+// The end's args win if the same name is in both.
+func mergeArgs(begin, end json.RawMessage) json.RawMessage {
+	if len(end) == 0 || string(end) == "null" {
+		return begin
+	}
+	if len(begin) == 0 || string(begin) == "null" {
+		return end
+	}
+	var fields map[string]json.RawMessage
+	if json.Unmarshal(begin, &fields) != nil || json.Unmarshal(end, &fields) != nil {
+		return begin
+	}
+	return must1(json.Marshal(fields))
+}
+
+// discardWriter throws everything away.
+type discardWriter struct{}
+
+func (discardWriter) writeBeginEvent(e Event)                   {}
+func (discardWriter) writeEndEvent(e Event)                     {}
+func (discardWriter) writeMarker(e Event)                       {}
+func (discardWriter) writeProcessName(pid int, name string)     {}
+func (discardWriter) writeThreadName(pid, tid int, name string) {}
+func (discardWriter) writePassThrough(line string)              {}
+func (discardWriter) close() error                              { return nil }
+
+// Spall's native binary format, as described by spall.h. Everything is
+// little-endian and packed with no padding.
+const (
+	spallMagic   = 0x0BADF00D
+	spallVersion = 1
+
+	spallEventTypeBegin = 3
+	spallEventTypeEnd   = 4
+
+	// Names and args are length-prefixed with a single byte.
+	spallMaxStringLength = 255
+)
+
+// binaryWriter emits a native .spall stream. Timestamps are written in
+// microseconds, matching Chrome's trace clock.
+//
+// Spall reads each thread's events in the order they appear in the file, so
+// time can never go backwards on a thread. The fudge offsets for JSON's
+// unstable sorts can make it, when a deep stack changes within a few
+// microseconds, so last holds the latest time written on each thread, and
+// anything earlier is moved up to it. Since the events stay in the same
+// order, frames stay nested the same way.
+//
+// Version 1 of the format has no way to name processes or threads, so names
+// are dropped, and warn is told the first time that happens.
+type binaryWriter struct {
+	w    io.Writer
+	buf  []byte
+	err  error
+	last map[threadID]float64
+
+	warn         func(err error)
+	droppedNames bool
+}
+
+func newBinaryWriter(w io.Writer, appending bool, warn func(err error)) *binaryWriter {
+	bw := &binaryWriter{w: w, last: make(map[threadID]float64), warn: warn}
+	if appending {
+		return bw
+	}
+
+	var header [32]byte
+	binary.LittleEndian.PutUint64(header[0:], spallMagic)
+	binary.LittleEndian.PutUint64(header[8:], spallVersion)
+	binary.LittleEndian.PutUint64(header[16:], math.Float64bits(1)) // timestamp unit: 1us
+	binary.LittleEndian.PutUint64(header[24:], 0)                   // must be zero
+	bw.write(header[:])
+
+	return bw
+}
+
+func (bw *binaryWriter) write(b []byte) {
+	if bw.err != nil {
+		return
+	}
+	_, bw.err = bw.w.Write(b)
+}
+
+// time returns the time to write an event at on its thread, which is never
+// before the last one.
+func (bw *binaryWriter) time(e Event) float64 {
+	id := threadID{e.Pid, e.Tid}
+	t, ok := bw.last[id]
+	if !ok || e.Time > t {
+		t = e.Time
+	}
+	bw.last[id] = t
+	return t
+}
+
+func (bw *binaryWriter) writeBeginEvent(e Event) {
+	name := e.Name
+	if len(name) > spallMaxStringLength {
+		// The length is in bytes, but don't leave half a character at
+		// the end.
+		n := spallMaxStringLength
+		for n > 0 && !utf8.RuneStart(name[n]) {
+			n--
+		}
+		name = name[:n]
+	}
+	args := e.Args
+	if len(args) > spallMaxStringLength {
+		// Cutting JSON short would only make it unreadable.
+		args = nil
+	}
+
+	b := bw.buf[:0]
+	b = append(b, spallEventTypeBegin, 0) // type, category
+	b = binary.LittleEndian.AppendUint32(b, uint32(e.Pid))
+	b = binary.LittleEndian.AppendUint32(b, uint32(e.Tid))
+	b = binary.LittleEndian.AppendUint64(b, math.Float64bits(bw.time(e)))
+	b = append(b, byte(len(name)), byte(len(args)))
+	b = append(b, name...)
+	b = append(b, args...)
+	bw.write(b)
+	bw.buf = b
+}
+
+func (bw *binaryWriter) writeEndEvent(e Event) {
+	b := bw.buf[:0]
+	b = append(b, spallEventTypeEnd)
+	b = binary.LittleEndian.AppendUint32(b, uint32(e.Pid))
+	b = binary.LittleEndian.AppendUint32(b, uint32(e.Tid))
+	b = binary.LittleEndian.AppendUint64(b, math.Float64bits(bw.time(e)))
+	bw.write(b)
+	bw.buf = b
+}
+
+func (bw *binaryWriter) writeMarker(e Event) {
+	bw.writeBeginEvent(e)
+	bw.writeEndEvent(e)
+}
+
+func (bw *binaryWriter) writeProcessName(pid int, name string) {
+	bw.dropName()
+}
+
+func (bw *binaryWriter) writeThreadName(pid, tid int, name string) {
+	bw.dropName()
+}
+
+// dropName warns, once, that the trace's names are being left out.
+func (bw *binaryWriter) dropName() {
+	if !bw.droppedNames && bw.warn != nil {
+		bw.warn(fmt.Errorf("%w; spall will show their ids instead", ErrNoNames))
+	}
+	bw.droppedNames = true
+}
+
+func (bw *binaryWriter) writePassThrough(line string) {
+	// The binary format has nowhere to put arbitrary trace events.
+}
+
+func (bw *binaryWriter) close() error {
+	return bw.err
+}
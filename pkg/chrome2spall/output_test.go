@@ -0,0 +1,189 @@
+package chrome2spall
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/quick"
+	"unicode/utf8"
+)
+
+func TestBinaryTimeNeverGoesBackwards(t *testing.T) {
+	// The stack changes every 2us, which the fudge offsets overshoot.
+	out := convertFile(t, filepath.Join("testdata", "fast.json"), Options{Format: "binary"})
+	if err := Validate(bytes.NewReader(out), "binary"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestBinaryMarkersInOrder(t *testing.T) {
+	// The markers come before and after the chunk that covers them, but
+	// belong in the middle of its frames.
+	out := convertFile(t, filepath.Join("testdata", "markers.json"), Options{Format: "binary"})
+	want := []string{
+		"B main 1111",
+		"B step 1211",
+		"B before 1250",
+		"E 1250",
+		"B after 1350",
+		"E 1350",
+		"E 1409",
+		"E 1509",
+	}
+	if got := binaryEvents(t, out); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got events:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+// binaryEvents describes each event in a binary output, one per line, as its
+// type, its name if it's a begin, and its time.
+func binaryEvents(t *testing.T, out []byte) []string {
+	t.Helper()
+	if len(out) < 32 {
+		t.Fatalf("output is only %d bytes", len(out))
+	}
+	b := out[32:]
+	var events []string
+	for len(b) > 0 {
+		switch b[0] {
+		case spallEventTypeBegin:
+			time := math.Float64frombits(binary.LittleEndian.Uint64(b[10:]))
+			nameLen, argsLen := int(b[18]), int(b[19])
+			events = append(events, fmt.Sprintf("B %s %v", b[20:20+nameLen], time))
+			b = b[20+nameLen+argsLen:]
+		case spallEventTypeEnd:
+			time := math.Float64frombits(binary.LittleEndian.Uint64(b[9:]))
+			events = append(events, fmt.Sprintf("E %v", time))
+			b = b[17:]
+		default:
+			t.Fatalf("unknown event type %d", b[0])
+		}
+	}
+	return events
+}
+
+func TestBinaryCompleteEventsInOrder(t *testing.T) {
+	// The complete events are out of order, and each one's end is written
+	// along with its begin. Layout begins where ParseHTML ends, and Paint
+	// takes no time at all where Layout ends.
+	out := convertFile(t, filepath.Join("testdata", "complete.json"), Options{Format: "binary", ExpandComplete: true})
+	want := []string{
+		"B RunTask 1000",
+		"B ParseHTML 1020",
+		"E 1070",
+		"B Layout 1070",
+		"E 1100",
+		"B Paint 1100",
+		"E 1100",
+		"B main 1111",
+		"B step 1211",
+		"E 1409",
+		"E 1509",
+		"E 1600",
+	}
+	if got := binaryEvents(t, out); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got events:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+// TestBinaryNames converts a trace that names its process and thread, and
+// expects binary output, which can't carry the names, to say so once.
+func TestBinaryNames(t *testing.T) {
+	for _, format := range []string{"json", "binary"} {
+		t.Run(format, func(t *testing.T) {
+			var warnings []error
+			opts := Options{Format: format, Warn: func(err error) { warnings = append(warnings, err) }}
+			convertFile(t, filepath.Join("testdata", "nested.json"), opts)
+			dropped := 0
+			for _, err := range warnings {
+				if errors.Is(err, ErrNoNames) {
+					dropped++
+				}
+			}
+			if want := map[string]int{"json": 0, "binary": 1}[format]; dropped != want {
+				t.Errorf("warned %d times about names, want %d: %v", dropped, want, warnings)
+			}
+		})
+	}
+}
+
+// TestAppendJSONString checks the hand-written string encoder against
+// encoding/json, on awkward strings and then on random ones, including
+// random bytes that aren't valid UTF-8.
+func TestAppendJSONString(t *testing.T) {
+	same := func(s string) bool {
+		return string(appendJSONString(nil, s)) == string(must1(json.Marshal(s)))
+	}
+	for _, s := range []string{
+		"", `a"b\c`, "tab\tnewline\n", "\x00\x1f\x7f", "<script>&</script>",
+		"\u2028\u2029", "caf\u00e9 \U0001F600", "\xff", "a\xc3", "\xed\xa0\x80",
+	} {
+		if !same(s) {
+			t.Errorf("%q encodes as %s, want %s", s, appendJSONString(nil, s), must1(json.Marshal(s)))
+		}
+	}
+	if err := quick.Check(same, nil); err != nil {
+		t.Error(err)
+	}
+	if err := quick.Check(func(b []byte) bool { return same(string(b)) }, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+// TestAppendJSONFloat checks the hand-written float encoder against
+// encoding/json.
+func TestAppendJSONFloat(t *testing.T) {
+	same := func(f float64) bool {
+		return string(appendJSONFloat(nil, f)) == string(must1(json.Marshal(f)))
+	}
+	for _, f := range []float64{0, math.Copysign(0, -1), 1, -1.5, 1e-6, 9.99e-7, 1e20, 1e21, 123456.789, math.MaxFloat64, math.SmallestNonzeroFloat64} {
+		if !same(f) {
+			t.Errorf("%v encodes as %s, want %s", f, appendJSONFloat(nil, f), must1(json.Marshal(f)))
+		}
+	}
+	if err := quick.Check(same, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+// TestAwkwardNames converts a frame named with a quote, a backslash, and a
+// character that takes more than one byte, to each format. Spall's names are
+// limited to 255 bytes, and a long one mustn't be cut mid-character.
+func TestAwkwardNames(t *testing.T) {
+	in, err := os.ReadFile(filepath.Join("testdata", "nested.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name, binaryName string
+	}{
+		{"a\"b\\c \U0001F600", "a\"b\\c \U0001F600"},
+		{strings.Repeat("\U0001F600", 100), strings.Repeat("\U0001F600", 63)},
+	}
+	for _, test := range tests {
+		trace := bytes.Replace(in, []byte(`"functionName":"main"`), append([]byte(`"functionName":`), must1(json.Marshal(test.name))...), 1)
+
+		found := false
+		for _, e := range jsonEvents(t, convertBytes(t, trace, Options{})) {
+			found = found || e.Ph == "B" && e.Name == test.name
+		}
+		if !found {
+			t.Errorf("no frame named %q in the JSON output", test.name)
+		}
+
+		events := binaryEvents(t, convertBytes(t, trace, Options{Format: "binary"}))
+		if want := "B " + test.binaryName + " 1111"; events[0] != want {
+			t.Errorf("first binary event is %q, want %q", events[0], want)
+		}
+		if !utf8.ValidString(events[0]) {
+			t.Errorf("binary name %q isn't valid UTF-8", events[0])
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package chrome2spall
+
+import "container/heap"
+
+// Converting in parallel: the input is still read on one goroutine, but the
+// stack reconstruction for each profile, which is where the time goes, is
+// handed off to a pool of workers. A profile always goes to the same worker,
+// so its chunks are still processed in order.
+
+// workerQueueLength is how much work can be waiting for each worker before
+// reading the input blocks.
+const workerQueueLength = 64
+
+func (c *Converter) startWorkers(n int) {
+	c.workers = make([]chan func(), n)
+	for i := range c.workers {
+		work := make(chan func(), workerQueueLength)
+		c.workers[i] = work
+		c.wg.Add(1)
+		go func() {
+			defer c.wg.Done()
+			for f := range work {
+				f()
+			}
+		}()
+	}
+}
+
+// run does some work on a profile: right away when converting serially, or
+// on the profile's worker when converting in parallel.
+func (c *Converter) run(profile *profileState, work func()) {
+	if c.workers == nil {
+		work()
+		return
+	}
+	c.workers[uint(profile.Pid)%uint(len(c.workers))] <- work
+}
+
+// stopWorkers waits for all outstanding work to finish.
+func (c *Converter) stopWorkers() {
+	for _, work := range c.workers {
+		close(work)
+	}
+	c.wg.Wait()
+	c.workers = nil
+}
+
+// bufferWriter holds on to the events of one profile being converted in
+// parallel. Profiles only ever emit begin and end events, and the names of
+// the tracks they make with Options.TrackByOrigin, which are held as
+// metadata events. The trace's own markers and complete events, which are
+// held the same way for the binary format, are held as instant events and
+// begins and ends.
+type bufferWriter struct {
+	discardWriter
+	events []Event
+}
+
+func (bw *bufferWriter) writeBeginEvent(e Event) {
+	bw.events = append(bw.events, e)
+}
+
+func (bw *bufferWriter) writeEndEvent(e Event) {
+	bw.events = append(bw.events, e)
+}
+
+func (bw *bufferWriter) writeMarker(e Event) {
+	e.Type = "I"
+	bw.events = append(bw.events, e)
+}
+
+func (bw *bufferWriter) writeThreadName(pid, tid int, name string) {
+	bw.events = append(bw.events, Event{Name: name, Type: "M", Pid: pid, Tid: tid})
+}
+
+// mergeBuffers writes out the buffered events of every profile, always
+// taking the earliest next event of any profile. Each profile's own events
+// stay in the order they were emitted, and ties go to the profile that
+// started first, so the output is the same regardless of how the work was
+// scheduled, or how many workers there were.
+//
+// The profiles' next events are kept in a heap, since there can be
+// thousands of profiles in a trace with a lot of workers or processes.
+func (c *Converter) mergeBuffers() {
+	h := make(mergeHeap, 0, len(c.buffers))
+	for i, buf := range c.buffers {
+		if len(buf.events) > 0 {
+			h = append(h, mergeCursor{buf: buf, order: i})
+		}
+	}
+	heap.Init(&h)
+	for len(h) > 0 {
+		cur := &h[0]
+		e := cur.buf.events[cur.next]
+		if e.Type == "M" {
+			c.out.writeThreadName(e.Pid, e.Tid, e.Name)
+		} else if e.Type == "I" {
+			e.Type = ""
+			c.out.writeMarker(e)
+		} else if e.Type == "B" {
+			c.out.writeBeginEvent(e)
+		} else {
+			c.out.writeEndEvent(e)
+		}
+
+		cur.next++
+		if cur.next < len(cur.buf.events) {
+			heap.Fix(&h, 0)
+		} else {
+			heap.Pop(&h)
+		}
+	}
+	c.buffers = nil
+}
+
+// mergeCursor is how far mergeBuffers has gotten through one profile's
+// events. order is when the profile started, relative to the others.
+type mergeCursor struct {
+	buf   *bufferWriter
+	next  int
+	order int
+}
+
+func (cur mergeCursor) time() float64 {
+	return cur.buf.events[cur.next].Time
+}
+
+// mergeHeap is a container/heap of the profiles that still have events to
+// write, with the one whose next event is earliest on top.
+type mergeHeap []mergeCursor
+
+func (h mergeHeap) Len() int      { return len(h) }
+func (h mergeHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h mergeHeap) Less(i, j int) bool {
+	if h[i].time() != h[j].time() {
+		return h[i].time() < h[j].time()
+	}
+	return h[i].order < h[j].order
+}
+
+func (h *mergeHeap) Push(x any) {
+	*h = append(*h, x.(mergeCursor))
+}
+
+func (h *mergeHeap) Pop() any {
+	old := *h
+	cur := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return cur
+}
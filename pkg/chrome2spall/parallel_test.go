@@ -0,0 +1,43 @@
+package chrome2spall
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// TestJobsOutputIdentical converts the same trace with different numbers of
+// workers, twice each, and expects the same output byte for byte every time.
+func TestJobsOutputIdentical(t *testing.T) {
+	trace := generateTrace(6, 3000)
+	for _, format := range []string{"json", "binary"} {
+		want := convertBytes(t, trace, Options{Format: format, Jobs: 1})
+		for _, jobs := range []int{1, 2, 3, 8} {
+			for run := 1; run <= 2; run++ {
+				t.Run(fmt.Sprintf("%s/jobs=%d/run=%d", format, jobs, run), func(t *testing.T) {
+					got := convertBytes(t, trace, Options{Format: format, Jobs: jobs})
+					if !bytes.Equal(got, want) {
+						t.Errorf("output differs from the conversion with one worker (%d bytes, want %d)", len(got), len(want))
+					}
+				})
+			}
+		}
+	}
+
+	// Without workers, JSON events come out in the order they're read
+	// rather than merged by time, but they're the same events.
+	t.Run("serial", func(t *testing.T) {
+		sortedLines := func(out []byte) string {
+			lines := strings.Split(string(out), "\n")
+			sort.Strings(lines)
+			return strings.Join(lines, "\n")
+		}
+		serial := convertBytes(t, trace, Options{})
+		parallel := convertBytes(t, trace, Options{Jobs: 2})
+		if sortedLines(serial) != sortedLines(parallel) {
+			t.Error("the serial conversion has different events from the parallel one")
+		}
+	})
+}
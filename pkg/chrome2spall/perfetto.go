@@ -0,0 +1,232 @@
+package chrome2spall
+
+import (
+	"encoding/binary"
+	"io"
+	"math"
+)
+
+// perfettoWriter emits a Perfetto Trace protobuf, as read by
+// ui.perfetto.dev. Each thread gets a track, and frames become slices on it.
+//
+// The protobuf is encoded by hand, since we only need a handful of fields.
+// Field numbers are from perfetto's trace_packet.proto, track_event.proto,
+// and track_descriptor.proto.
+type perfettoWriter struct {
+	w   io.Writer
+	buf []byte
+	err error
+
+	processNames map[int]string
+	threadNames  map[threadID]string
+
+	// described holds the tracks we've already written a descriptor for.
+	described map[uint64]bool
+}
+
+const (
+	// Trace
+	perfettoTracePacket = 1
+
+	// TracePacket
+	perfettoPacketTimestamp       = 8
+	perfettoPacketSequenceID      = 10
+	perfettoPacketTrackEvent      = 11
+	perfettoPacketTrackDescriptor = 60
+
+	// TrackDescriptor
+	perfettoTrackUUID       = 1
+	perfettoTrackProcess    = 3
+	perfettoTrackThread     = 4
+	perfettoTrackParentUUID = 5
+
+	// ProcessDescriptor
+	perfettoProcessPid  = 1
+	perfettoProcessName = 6
+
+	// ThreadDescriptor
+	perfettoThreadPid  = 1
+	perfettoThreadTid  = 2
+	perfettoThreadName = 5
+
+	// TrackEvent
+	perfettoEventType       = 9
+	perfettoEventTrackUUID  = 11
+	perfettoEventCategories = 22
+	perfettoEventName       = 23
+
+	// TrackEvent.Type
+	perfettoSliceBegin = 1
+	perfettoSliceEnd   = 2
+	perfettoInstant    = 3
+
+	// Every packet comes from the same (and only) sequence.
+	perfettoSequenceID = 1
+)
+
+func newPerfettoWriter(w io.Writer) *perfettoWriter {
+	return &perfettoWriter{
+		w:            w,
+		processNames: make(map[int]string),
+		threadNames:  make(map[threadID]string),
+		described:    make(map[uint64]bool),
+	}
+}
+
+// Tracks are identified by uuids that we make up from the pid and tid. The
+// top bit keeps process tracks apart from thread tracks.
+
+func processUUID(pid int) uint64 {
+	return 1<<63 | uint64(uint32(pid))
+}
+
+func threadUUID(pid, tid int) uint64 {
+	return uint64(uint32(pid))<<32 | uint64(uint32(tid))
+}
+
+func (pw *perfettoWriter) writeBeginEvent(e Event) {
+	pw.writeTrackEvent(e, perfettoSliceBegin)
+}
+
+func (pw *perfettoWriter) writeEndEvent(e Event) {
+	pw.writeTrackEvent(e, perfettoSliceEnd)
+}
+
+func (pw *perfettoWriter) writeMarker(e Event) {
+	pw.writeTrackEvent(e, perfettoInstant)
+}
+
+func (pw *perfettoWriter) writeTrackEvent(e Event, eventType uint64) {
+	pw.describeThread(e.Pid, e.Tid)
+
+	var event []byte
+	event = appendProtoVarint(event, perfettoEventType, eventType)
+	event = appendProtoVarint(event, perfettoEventTrackUUID, threadUUID(e.Pid, e.Tid))
+	if eventType != perfettoSliceEnd {
+		if e.Category != "" {
+			for _, cat := range e.Categories() {
+				event = appendProtoBytes(event, perfettoEventCategories, []byte(cat))
+			}
+		}
+		event = appendProtoBytes(event, perfettoEventName, []byte(e.Name))
+	}
+
+	// Perfetto wants whole nanoseconds, and can't go before zero.
+	ns := uint64(math.Round(max(e.Time, 0) * 1000))
+
+	packet := pw.buf[:0]
+	packet = appendProtoVarint(packet, perfettoPacketTimestamp, ns)
+	packet = appendProtoVarint(packet, perfettoPacketSequenceID, perfettoSequenceID)
+	packet = appendProtoBytes(packet, perfettoPacketTrackEvent, event)
+	pw.writePacket(packet)
+	pw.buf = packet
+}
+
+func (pw *perfettoWriter) writeProcessName(pid int, name string) {
+	pw.processNames[pid] = name
+	pw.described[processUUID(pid)] = false
+	pw.describeProcess(pid)
+}
+
+func (pw *perfettoWriter) writeThreadName(pid, tid int, name string) {
+	pw.threadNames[threadID{pid, tid}] = name
+	pw.described[threadUUID(pid, tid)] = false
+	pw.describeThread(pid, tid)
+}
+
+// describeProcess writes a track descriptor for a process, unless we already
+// have. Names may well show up after a track's first event, in which case
+// the track is described again.
+func (pw *perfettoWriter) describeProcess(pid int) {
+	uuid := processUUID(pid)
+	if pw.described[uuid] {
+		return
+	}
+	pw.described[uuid] = true
+
+	var process []byte
+	process = appendProtoVarint(process, perfettoProcessPid, uint64(pid))
+	if name, ok := pw.processNames[pid]; ok {
+		process = appendProtoBytes(process, perfettoProcessName, []byte(name))
+	}
+
+	var track []byte
+	track = appendProtoVarint(track, perfettoTrackUUID, uuid)
+	track = appendProtoBytes(track, perfettoTrackProcess, process)
+	pw.writeTrackDescriptor(track)
+}
+
+func (pw *perfettoWriter) describeThread(pid, tid int) {
+	pw.describeProcess(pid)
+
+	uuid := threadUUID(pid, tid)
+	if pw.described[uuid] {
+		return
+	}
+	pw.described[uuid] = true
+
+	var thread []byte
+	thread = appendProtoVarint(thread, perfettoThreadPid, uint64(pid))
+	thread = appendProtoVarint(thread, perfettoThreadTid, uint64(tid))
+	if name, ok := pw.threadNames[threadID{pid, tid}]; ok {
+		thread = appendProtoBytes(thread, perfettoThreadName, []byte(name))
+	}
+
+	var track []byte
+	track = appendProtoVarint(track, perfettoTrackUUID, uuid)
+	track = appendProtoVarint(track, perfettoTrackParentUUID, processUUID(pid))
+	track = appendProtoBytes(track, perfettoTrackThread, thread)
+	pw.writeTrackDescriptor(track)
+}
+
+func (pw *perfettoWriter) writeTrackDescriptor(track []byte) {
+	var packet []byte
+	packet = appendProtoVarint(packet, perfettoPacketSequenceID, perfettoSequenceID)
+	packet = appendProtoBytes(packet, perfettoPacketTrackDescriptor, track)
+	pw.writePacket(packet)
+}
+
+// writePacket writes one TracePacket. A Trace is nothing but a sequence of
+// them, so there's no header or footer to worry about.
+func (pw *perfettoWriter) writePacket(packet []byte) {
+	if pw.err != nil {
+		return
+	}
+	var prefix []byte
+	prefix = appendProtoTag(prefix, perfettoTracePacket, protoWireBytes)
+	prefix = binary.AppendUvarint(prefix, uint64(len(packet)))
+	if _, pw.err = pw.w.Write(prefix); pw.err != nil {
+		return
+	}
+	_, pw.err = pw.w.Write(packet)
+}
+
+func (pw *perfettoWriter) writePassThrough(line string) {
+	// Perfetto has nowhere to put arbitrary trace events.
+}
+
+func (pw *perfettoWriter) close() error {
+	return pw.err
+}
+
+const (
+	protoWireVarint = 0
+	protoWireBytes  = 2
+)
+
+func appendProtoTag(b []byte, field, wireType int) []byte {
+	return binary.AppendUvarint(b, uint64(field)<<3|uint64(wireType))
+}
+
+// appendProtoVarint appends a varint field. Negative ints must be converted
+// with uint64(v), which is how protobuf encodes int32 and int64.
+func appendProtoVarint(b []byte, field int, v uint64) []byte {
+	b = appendProtoTag(b, field, protoWireVarint)
+	return binary.AppendUvarint(b, v)
+}
+
+func appendProtoBytes(b []byte, field int, v []byte) []byte {
+	b = appendProtoTag(b, field, protoWireBytes)
+	b = binary.AppendUvarint(b, uint64(len(v)))
+	return append(b, v...)
+}
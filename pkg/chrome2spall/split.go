@@ -0,0 +1,109 @@
+package chrome2spall
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
+)
+
+// splitWriter sends each process's events to an output of its own. Outputs
+// are opened the first time their process shows up, so processes that end up
+// with nothing in them don't leave empty files behind.
+type splitWriter struct {
+	opts Options
+	open func(pid int) (io.WriteCloser, error)
+
+	outputs map[int]*splitOutput
+	err     error
+}
+
+type splitOutput struct {
+	eventWriter
+	w io.WriteCloser
+}
+
+func newSplitWriter(opts Options) (*splitWriter, error) {
+	// Catch a bad format now, rather than on the first event.
+	if _, err := newEventWriter(io.Discard, opts); err != nil {
+		return nil, err
+	}
+	return &splitWriter{
+		opts:    opts,
+		open:    opts.SplitOutput,
+		outputs: make(map[int]*splitOutput),
+	}, nil
+}
+
+// output returns the writer for a process, opening it if necessary. If it
+// can't be opened, everything for that process is dropped, and the error is
+// reported by close.
+func (sw *splitWriter) output(pid int) eventWriter {
+	if out, ok := sw.outputs[pid]; ok {
+		return out
+	}
+
+	out := &splitOutput{eventWriter: discardWriter{}}
+	w, err := sw.open(pid)
+	if err != nil {
+		if sw.err == nil {
+			sw.err = fmt.Errorf("pid %d: %w", pid, err)
+		}
+	} else {
+		out.w = w
+		out.eventWriter = must1(newEventWriter(w, sw.opts))
+	}
+	sw.outputs[pid] = out
+	return out
+}
+
+func (sw *splitWriter) writeBeginEvent(e Event) {
+	sw.output(e.Pid).writeBeginEvent(e)
+}
+
+func (sw *splitWriter) writeEndEvent(e Event) {
+	sw.output(e.Pid).writeEndEvent(e)
+}
+
+func (sw *splitWriter) writeMarker(e Event) {
+	sw.output(e.Pid).writeMarker(e)
+}
+
+func (sw *splitWriter) writeProcessName(pid int, name string) {
+	sw.output(pid).writeProcessName(pid, name)
+}
+
+func (sw *splitWriter) writeThreadName(pid, tid int, name string) {
+	sw.output(pid).writeThreadName(pid, tid, name)
+}
+
+func (sw *splitWriter) writePassThrough(line string) {
+	// Events without a pid (or that we can't read) go with pid 0's.
+	var event struct {
+		Pid int `json:"pid"`
+	}
+	json.Unmarshal([]byte(line), &event)
+	sw.output(event.Pid).writePassThrough(line)
+}
+
+func (sw *splitWriter) close() error {
+	err := sw.err
+	pids := maps.Keys(sw.outputs)
+	slices.Sort(pids)
+	for _, pid := range pids {
+		out := sw.outputs[pid]
+		if out.w == nil {
+			continue
+		}
+		cerr := out.eventWriter.close()
+		if werr := out.w.Close(); cerr == nil {
+			cerr = werr
+		}
+		if err == nil && cerr != nil {
+			err = fmt.Errorf("pid %d: %w", pid, cerr)
+		}
+	}
+	return err
+}
@@ -0,0 +1,219 @@
+package chrome2spall
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
+)
+
+// Stats summarizes a conversion.
+type Stats struct {
+	Pids         map[int]bool
+	Samples      int
+	GCSamples    int
+	IdleSamples  int
+	ParseErrors  int
+	OrphanChunks int // ProfileChunks converted without ever seeing their Profile
+
+	// KeptSamples counts the samples that weren't dropped by
+	// Options.Downsample, and SampledTime is the total time, in
+	// microseconds, that all of the samples covered.
+	KeptSamples int
+	SampledTime float64
+
+	ClampedDeltas int // negative time deltas treated as zero
+	ClampedEnds   int // end events moved so they don't come before their begin
+
+	// Truncated is set if the input stopped partway through an event, and
+	// MismatchedChunks counts the ProfileChunks that had a different number
+	// of samples and time deltas. Either way, the input was probably cut
+	// off.
+	Truncated        bool
+	MismatchedChunks int
+
+	BeginEvents, EndEvents int
+	Markers                int
+	FirstTime, LastTime    float64
+
+	// EventLimitReached is set if Options.MaxEvents cut the output short.
+	// Then the rest of the input isn't read, if it can be helped, and
+	// InputUnread is set. InputFirstTime and InputLastTime are the time
+	// span of all the frames that could have been written from what was
+	// read, to compare with FirstTime and LastTime.
+	EventLimitReached             bool
+	InputUnread                   bool
+	InputFirstTime, InputLastTime float64
+
+	// Processes describes each process in the input, whether or not it was
+	// converted.
+	Processes map[int]*ProcessStats
+
+	// PidOffsets holds the offset added to the pids of each input, in the
+	// order they were added, or -1 for those whose pids were left alone.
+	PidOffsets []int
+}
+
+// ProcessStats describes what one process contributed to the input.
+type ProcessStats struct {
+	Name                string
+	Profiles            int // Profile events, or standalone .cpuprofiles
+	Chunks              int
+	Samples             int
+	Nodes               int
+	FirstTime, LastTime float64 // of the samples in its profiles
+	ThreadNames         map[int]string
+	Main                bool // renders the page's main frame
+
+	seen bool // whether FirstTime and LastTime are set
+}
+
+func (s *Stats) process(pid int) *ProcessStats {
+	p, ok := s.Processes[pid]
+	if !ok {
+		p = &ProcessStats{ThreadNames: make(map[int]string)}
+		s.Processes[pid] = p
+	}
+	return p
+}
+
+func (p *ProcessStats) see(t float64) {
+	if !p.seen {
+		p.FirstTime, p.LastTime = t, t
+		p.seen = true
+	}
+	p.FirstTime = min(p.FirstTime, t)
+	p.LastTime = max(p.LastTime, t)
+}
+
+// Print writes the stats in a human-readable form. names are the names of
+// the inputs, in the order they were added, which are listed with their pid
+// offsets if there's more than one.
+func (s *Stats) Print(w io.Writer, names []string) {
+	fmt.Fprintf(w, "Pids seen:              %d\n", len(s.Pids))
+	fmt.Fprintf(w, "Samples processed:      %d (%d GC, %d idle)\n", s.Samples, s.GCSamples, s.IdleSamples)
+	if s.KeptSamples < s.Samples && s.KeptSamples > 0 {
+		fmt.Fprintf(w, "Samples kept:           %d (one every %s, instead of every %s)\n", s.KeptSamples, formatInterval(s.SampledTime/float64(s.KeptSamples)), formatInterval(s.SampledTime/float64(s.Samples)))
+	}
+	fmt.Fprintf(w, "Begin events emitted:   %d\n", s.BeginEvents)
+	fmt.Fprintf(w, "End events emitted:     %d\n", s.EndEvents)
+	if s.Markers > 0 {
+		fmt.Fprintf(w, "Markers emitted:        %d\n", s.Markers)
+	}
+	fmt.Fprintf(w, "Events failed to parse: %d\n", s.ParseErrors)
+	if s.OrphanChunks > 0 {
+		fmt.Fprintf(w, "Chunks with no Profile: %d\n", s.OrphanChunks)
+	}
+	if s.ClampedDeltas > 0 {
+		fmt.Fprintf(w, "Negative time deltas:   %d (clamped to zero)\n", s.ClampedDeltas)
+	}
+	if s.ClampedEnds > 0 {
+		fmt.Fprintf(w, "Ends before begins:     %d (moved up to the begin)\n", s.ClampedEnds)
+	}
+	if s.MismatchedChunks > 0 {
+		fmt.Fprintf(w, "Chunks cut short:       %d\n", s.MismatchedChunks)
+	}
+	if s.Truncated || s.MismatchedChunks > 0 {
+		fmt.Fprintln(w, "The input appears to have been truncated; frames still open at the end were closed at the last sample.")
+	}
+	if s.EventLimitReached {
+		if s.InputUnread {
+			fmt.Fprintln(w, "The output was cut off at the event limit, and the rest of the input was never read.")
+		} else {
+			fmt.Fprintln(w, "The output was cut off at the event limit.")
+		}
+	}
+	if s.BeginEvents+s.EndEvents > 0 {
+		fmt.Fprintf(w, "Time span:              %sus to %sus (%.3fms)\n", formatMicros(s.FirstTime), formatMicros(s.LastTime), (s.LastTime-s.FirstTime)/1000)
+	}
+	if len(names) > 1 {
+		fmt.Fprintln(w, "Pid offsets:")
+		for i, name := range names {
+			offset := i * MultiFilePidOffset
+			if i < len(s.PidOffsets) {
+				offset = s.PidOffsets[i]
+			}
+			if offset < 0 {
+				fmt.Fprintf(w, "  none: %s\n", name)
+			} else {
+				fmt.Fprintf(w, "  +%d: %s\n", offset, name)
+			}
+		}
+	}
+}
+
+// PrintProcesses writes a human-readable description of each process.
+func (s *Stats) PrintProcesses(w io.Writer) {
+	pids := maps.Keys(s.Processes)
+	slices.Sort(pids)
+	for _, pid := range pids {
+		p := s.Processes[pid]
+		if p.Name != "" {
+			fmt.Fprintf(w, "Pid %d (%s):\n", pid, p.Name)
+		} else {
+			fmt.Fprintf(w, "Pid %d:\n", pid)
+		}
+		if p.Main {
+			fmt.Fprintln(w, "  Main frame:    yes (use --main-only to convert just this)")
+		}
+		fmt.Fprintf(w, "  Profiles:      %d\n", p.Profiles)
+		fmt.Fprintf(w, "  ProfileChunks: %d\n", p.Chunks)
+		fmt.Fprintf(w, "  Samples:       %d\n", p.Samples)
+		fmt.Fprintf(w, "  Nodes:         %d\n", p.Nodes)
+		if p.seen {
+			fmt.Fprintf(w, "  Time span:     %sus to %sus (%.3fms)\n", formatMicros(p.FirstTime), formatMicros(p.LastTime), (p.LastTime-p.FirstTime)/1000)
+		}
+		if len(p.ThreadNames) > 0 {
+			tids := maps.Keys(p.ThreadNames)
+			slices.Sort(tids)
+			fmt.Fprintln(w, "  Threads:")
+			for _, tid := range tids {
+				fmt.Fprintf(w, "    %d: %s\n", tid, p.ThreadNames[tid])
+			}
+		}
+	}
+}
+
+// formatMicros formats a timestamp with as many digits as it needs, so whole
+// microseconds print without a fraction.
+func formatMicros(t float64) string {
+	return strconv.FormatFloat(t, 'f', -1, 64)
+}
+
+// formatInterval formats an average time between samples, in microseconds.
+func formatInterval(us float64) string {
+	return strconv.FormatFloat(us, 'f', 1, 64) + "us"
+}
+
+// countingWriter tallies the events actually written to the output.
+type countingWriter struct {
+	eventWriter
+	stats *Stats
+}
+
+func (cw *countingWriter) writeBeginEvent(e Event) {
+	cw.stats.BeginEvents++
+	cw.see(e.Time)
+	cw.eventWriter.writeBeginEvent(e)
+}
+
+func (cw *countingWriter) writeEndEvent(e Event) {
+	cw.stats.EndEvents++
+	cw.see(e.Time)
+	cw.eventWriter.writeEndEvent(e)
+}
+
+func (cw *countingWriter) writeMarker(e Event) {
+	cw.stats.Markers++
+	cw.eventWriter.writeMarker(e)
+}
+
+func (cw *countingWriter) see(t float64) {
+	if cw.stats.BeginEvents+cw.stats.EndEvents == 1 {
+		cw.stats.FirstTime, cw.stats.LastTime = t, t
+	}
+	cw.stats.FirstTime = min(cw.stats.FirstTime, t)
+	cw.stats.LastTime = max(cw.stats.LastTime, t)
+}
@@ -0,0 +1,41 @@
+package chrome2spall
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestProcessTimeSpan(t *testing.T) {
+	// The span is of the samples, from the profile's start time plus each
+	// time delta, not of the events' timestamps: the chunks are posted
+	// after their samples were taken.
+	tests := []struct {
+		input       string
+		first, last float64
+	}{
+		{"nested.json", 1010, 2010},
+		{"missing-profile.json", 10, 410},
+	}
+	for _, test := range tests {
+		for _, countOnly := range []bool{false, true} {
+			in, err := os.ReadFile(filepath.Join("testdata", test.input))
+			if err != nil {
+				t.Fatal(err)
+			}
+			stats, err := Convert(bytes.NewReader(in), io.Discard, Options{CountOnly: countOnly})
+			if err != nil {
+				t.Fatal(err)
+			}
+			p := stats.Processes[10]
+			if p == nil {
+				t.Fatalf("%s: no stats for pid 10", test.input)
+			}
+			if p.FirstTime != test.first || p.LastTime != test.last {
+				t.Errorf("%s, CountOnly %v: time span is %v to %v, want %v to %v", test.input, countOnly, p.FirstTime, p.LastTime, test.first, test.last)
+			}
+		}
+	}
+}
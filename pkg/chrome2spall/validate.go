@@ -0,0 +1,261 @@
+package chrome2spall
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
+)
+
+// ErrCannotValidate means that Validate can't read the given format.
+var ErrCannotValidate = errors.New("can't validate")
+
+// Validate reads back an output written in the given format ("json" or
+// "binary") and checks that every thread's frames are properly balanced:
+// each end matches the most recent open begin, no frame ends before it
+// began, and nothing is left open at the end. The error describes the first
+// problem found.
+//
+// Viewers sort JSON events by time before matching them up, so JSON is
+// checked in time order. The binary format is read in order, so there the
+// timestamps of each thread must never go backwards, too.
+func Validate(r io.Reader, format string) error {
+	switch format {
+	case "json":
+		return validateJSON(bufio.NewReader(r))
+	case "binary":
+		return validateBinary(bufio.NewReader(r))
+	default:
+		return fmt.Errorf("%w %s output (only json and binary)", ErrCannotValidate, format)
+	}
+}
+
+// validationEvent is the part of an output event that matters for balance.
+// Index counts the events in the output from 1.
+type validationEvent struct {
+	Index int
+	Type  string
+	Name  string
+	Time  float64
+	Dur   float64
+}
+
+// frameChecker matches up the begins and ends on each thread.
+type frameChecker struct {
+	open map[threadID][]validationEvent
+}
+
+func (fc *frameChecker) check(id threadID, e validationEvent) error {
+	stack := fc.open[id]
+	switch e.Type {
+	case "B":
+		fc.open[id] = append(stack, e)
+	case "E":
+		if len(stack) == 0 {
+			return fmt.Errorf("event %d: end at %sus on pid %d, tid %d has no begin", e.Index, formatMicros(e.Time), id.Pid, id.Tid)
+		}
+		begin := stack[len(stack)-1]
+		if e.Time < begin.Time {
+			return fmt.Errorf("event %d: %q on pid %d, tid %d ends at %sus, before it began at %sus (event %d)", e.Index, begin.Name, id.Pid, id.Tid, formatMicros(e.Time), formatMicros(begin.Time), begin.Index)
+		}
+		fc.open[id] = stack[:len(stack)-1]
+	case "X":
+		if e.Dur < 0 {
+			return fmt.Errorf("event %d: %q on pid %d, tid %d has a negative duration", e.Index, e.Name, id.Pid, id.Tid)
+		}
+	}
+	return nil
+}
+
+// finish reports a frame that never ended, if there is one.
+func (fc *frameChecker) finish() error {
+	ids := maps.Keys(fc.open)
+	slices.SortFunc(ids, threadID.less)
+	for _, id := range ids {
+		if stack := fc.open[id]; len(stack) > 0 {
+			begin := stack[len(stack)-1]
+			return fmt.Errorf("event %d: %q on pid %d, tid %d, begun at %sus, never ends", begin.Index, begin.Name, id.Pid, id.Tid, formatMicros(begin.Time))
+		}
+	}
+	return nil
+}
+
+func validateJSON(br *bufio.Reader) error {
+	// Skip to the start of the array, whether or not it's wrapped in an
+	// object.
+	for {
+		b, err := br.ReadByte()
+		if err != nil {
+			return errors.New("no array of events in the output")
+		}
+		if b == '[' {
+			break
+		}
+	}
+
+	tracks := make(map[threadID][]validationEvent)
+	var raw []byte
+	for index := 1; ; index++ {
+		var err error
+		raw, err = nextJSONObject(br, raw[:0])
+		if err != nil {
+			return fmt.Errorf("event %d: %w", index, err)
+		}
+		if raw == nil {
+			break
+		}
+		var e struct {
+			Name string  `json:"name"`
+			Type string  `json:"ph"`
+			Time float64 `json:"ts"`
+			Dur  float64 `json:"dur"`
+			Pid  int     `json:"pid"`
+			Tid  int     `json:"tid"`
+		}
+		if err := json.Unmarshal(raw, &e); err != nil {
+			return fmt.Errorf("event %d: %w", index, err)
+		}
+		if e.Type != "B" && e.Type != "E" && e.Type != "X" {
+			continue
+		}
+		id := threadID{e.Pid, e.Tid}
+		tracks[id] = append(tracks[id], validationEvent{index, e.Type, e.Name, e.Time, e.Dur})
+	}
+
+	fc := frameChecker{open: make(map[threadID][]validationEvent)}
+	ids := maps.Keys(tracks)
+	slices.SortFunc(ids, threadID.less)
+	for _, id := range ids {
+		events := tracks[id]
+		slices.SortStableFunc(events, func(a, b validationEvent) bool {
+			return a.Time < b.Time
+		})
+		for _, e := range events {
+			if err := fc.check(id, e); err != nil {
+				return err
+			}
+		}
+	}
+	return fc.finish()
+}
+
+// nextJSONObject reads the next object from an array of events, appending
+// it to buf. The commas between (or after) events are skipped. It returns nil
+// at the end of the array.
+func nextJSONObject(br *bufio.Reader, buf []byte) ([]byte, error) {
+	var b byte
+	var err error
+	for {
+		b, err = br.ReadByte()
+		if err != nil {
+			return nil, errors.New("the array of events never ends")
+		}
+		if b == ']' {
+			return nil, nil
+		}
+		if b == '{' {
+			break
+		}
+		if b != ',' && b != ' ' && b != '\t' && b != '\r' && b != '\n' {
+			return nil, fmt.Errorf("unexpected %q between events", b)
+		}
+	}
+
+	buf = append(buf, b)
+	depth, inString, escaped := 1, false, false
+	for depth > 0 {
+		b, err = br.ReadByte()
+		if err != nil {
+			return nil, errors.New("the output ends partway through an event")
+		}
+		buf = append(buf, b)
+		switch {
+		case escaped:
+			escaped = false
+		case inString:
+			escaped = b == '\\'
+			inString = b != '"'
+		case b == '"':
+			inString = true
+		case b == '{' || b == '[':
+			depth++
+		case b == '}' || b == ']':
+			depth--
+		}
+	}
+	return buf, nil
+}
+
+func validateBinary(br *bufio.Reader) error {
+	var header [32]byte
+	if _, err := io.ReadFull(br, header[:]); err != nil {
+		return errors.New("the output is too short to have a spall header")
+	}
+	if magic := binary.LittleEndian.Uint64(header[0:]); magic != spallMagic {
+		return fmt.Errorf("the header's magic number is %#x, not %#x", magic, spallMagic)
+	}
+	if version := binary.LittleEndian.Uint64(header[8:]); version != spallVersion {
+		return fmt.Errorf("the header's version is %d, not %d", version, spallVersion)
+	}
+	if unit := math.Float64frombits(binary.LittleEndian.Uint64(header[16:])); !(unit > 0) {
+		return fmt.Errorf("the header's timestamp unit is %v", unit)
+	}
+	if binary.LittleEndian.Uint64(header[24:]) != 0 {
+		return errors.New("the header's last field isn't zero")
+	}
+
+	fc := frameChecker{open: make(map[threadID][]validationEvent)}
+	last := make(map[threadID]float64)
+	for index := 1; ; index++ {
+		eventType, err := br.ReadByte()
+		if err == io.EOF {
+			break
+		}
+
+		var e validationEvent
+		var fixed [17]byte // pid, tid, and time, plus a category for begins
+		size := 16
+		switch eventType {
+		case spallEventTypeBegin:
+			e.Type = "B"
+			size = 17
+		case spallEventTypeEnd:
+			e.Type = "E"
+		default:
+			return fmt.Errorf("event %d: unknown event type %d", index, eventType)
+		}
+		if _, err := io.ReadFull(br, fixed[:size]); err != nil {
+			return fmt.Errorf("event %d: the output ends partway through it", index)
+		}
+		b := fixed[size-16:]
+		id := threadID{int(binary.LittleEndian.Uint32(b[0:])), int(binary.LittleEndian.Uint32(b[4:]))}
+		e.Index = index
+		e.Time = math.Float64frombits(binary.LittleEndian.Uint64(b[8:]))
+		if e.Type == "B" {
+			var lengths [2]byte
+			if _, err := io.ReadFull(br, lengths[:]); err != nil {
+				return fmt.Errorf("event %d: the output ends partway through it", index)
+			}
+			strs := make([]byte, int(lengths[0])+int(lengths[1]))
+			if _, err := io.ReadFull(br, strs); err != nil {
+				return fmt.Errorf("event %d: the output ends partway through it", index)
+			}
+			e.Name = string(strs[:lengths[0]])
+		}
+
+		if t, ok := last[id]; ok && e.Time < t {
+			return fmt.Errorf("event %d: time goes backwards on pid %d, tid %d, from %sus to %sus", index, id.Pid, id.Tid, formatMicros(t), formatMicros(e.Time))
+		}
+		last[id] = e.Time
+		if err := fc.check(id, e); err != nil {
+			return err
+		}
+	}
+	return fc.finish()
+}
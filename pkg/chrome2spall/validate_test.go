@@ -0,0 +1,131 @@
+package chrome2spall
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestValidateOutput checks that whatever the converter writes passes
+// Validate, in both formats, with the options that change how frames are
+// written.
+func TestValidateOutput(t *testing.T) {
+	inputs, err := filepath.Glob(filepath.Join("testdata", "*.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	variants := map[string]Options{
+		"default":         {},
+		"complete-events": {CompleteEvents: true},
+		"expand-complete": {ExpandComplete: true},
+		"jobs":            {Jobs: 2},
+		"streaming":       {Streaming: true},
+		"merge-threads":   {MergeThreads: true},
+		"track-by-origin": {TrackByOrigin: true},
+		"gc-as-sibling":   {GCAsSibling: true},
+	}
+	for _, format := range []string{"json", "binary"} {
+		for variant, opts := range variants {
+			opts.Format = format
+			for _, input := range inputs {
+				name := fmt.Sprintf("%s/%s/%s", format, variant, strings.TrimSuffix(filepath.Base(input), ".json"))
+				t.Run(name, func(t *testing.T) {
+					out := convertFile(t, input, opts)
+					if err := Validate(bytes.NewReader(out), format); err != nil {
+						t.Error(err)
+					}
+				})
+			}
+		}
+	}
+}
+
+func TestValidateJSON(t *testing.T) {
+	tests := []struct {
+		name   string
+		events string
+		err    string // empty if it's fine
+	}{
+		{"empty", ``, ""},
+		{"balanced", `{"ph":"B","ts":1,"pid":1,"tid":1},{"ph":"E","ts":2,"pid":1,"tid":1},`, ""},
+		{"sorted by time", `{"ph":"E","ts":2,"pid":1,"tid":1},{"ph":"B","ts":1,"pid":1,"tid":1},`, ""},
+		{"threads apart", `{"ph":"B","ts":1,"pid":1,"tid":1},{"ph":"E","ts":2,"pid":1,"tid":2},`, "has no begin"},
+		{"never ends", `{"name":"f","ph":"B","ts":1,"pid":1,"tid":1},`, `"f" on pid 1, tid 1, begun at 1us, never ends`},
+		{"negative duration", `{"name":"f","ph":"X","ts":1,"dur":-1,"pid":1,"tid":1},`, "negative duration"},
+		{"metadata ignored", `{"name":"thread_name","ph":"M","pid":1,"tid":1,"args":{"name":"a"}},`, ""},
+		{"cut off", `{"ph":"B","ts":1,`, "partway through an event"},
+		{"no end of array", `{"ph":"B","ts":1,"pid":1,"tid":1}`, "never ends"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			out := "[\n" + test.events
+			if test.name != "cut off" && test.name != "no end of array" {
+				out += "]\n"
+			}
+			checkValidation(t, Validate(strings.NewReader(out), "json"), test.err)
+		})
+	}
+}
+
+func TestValidateBinary(t *testing.T) {
+	header := func(magic uint64) []byte {
+		b := binary.LittleEndian.AppendUint64(nil, magic)
+		b = binary.LittleEndian.AppendUint64(b, spallVersion)
+		b = binary.LittleEndian.AppendUint64(b, math.Float64bits(1))
+		return binary.LittleEndian.AppendUint64(b, 0)
+	}
+	begin := func(b []byte, tid int, time float64, name string) []byte {
+		b = append(b, spallEventTypeBegin, 0)
+		b = binary.LittleEndian.AppendUint32(b, 1)
+		b = binary.LittleEndian.AppendUint32(b, uint32(tid))
+		b = binary.LittleEndian.AppendUint64(b, math.Float64bits(time))
+		b = append(b, byte(len(name)), 0)
+		return append(b, name...)
+	}
+	end := func(b []byte, tid int, time float64) []byte {
+		b = append(b, spallEventTypeEnd)
+		b = binary.LittleEndian.AppendUint32(b, 1)
+		b = binary.LittleEndian.AppendUint32(b, uint32(tid))
+		return binary.LittleEndian.AppendUint64(b, math.Float64bits(time))
+	}
+
+	tests := []struct {
+		name string
+		out  []byte
+		err  string // empty if it's fine
+	}{
+		{"empty", header(spallMagic), ""},
+		{"balanced", end(begin(header(spallMagic), 1, 1, "f"), 1, 2), ""},
+		{"threads apart", end(begin(header(spallMagic), 1, 2, "f"), 2, 1), "has no begin"},
+		{"backwards", end(begin(header(spallMagic), 1, 2, "f"), 1, 1), "time goes backwards on pid 1, tid 1, from 2us to 1us"},
+		{"never ends", begin(header(spallMagic), 1, 1, "f"), `"f" on pid 1, tid 1, begun at 1us, never ends`},
+		{"wrong magic", header(1), "magic number"},
+		{"no header", nil, "too short"},
+		{"cut off", begin(header(spallMagic), 1, 1, "f")[:40], "partway through"},
+		{"unknown event", append(header(spallMagic), 9), "unknown event type 9"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			checkValidation(t, Validate(bytes.NewReader(test.out), "binary"), test.err)
+		})
+	}
+}
+
+func checkValidation(t *testing.T, err error, want string) {
+	t.Helper()
+	if want == "" {
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		return
+	}
+	if err == nil {
+		t.Errorf("no error, want one containing %q", want)
+	} else if !strings.Contains(err.Error(), want) {
+		t.Errorf("got error %q, want one containing %q", err, want)
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// progressInterval is how often the progress line is redrawn.
+const progressInterval = 200 * time.Millisecond
+
+// showProgress reports whether --progress asks for progress to be shown.
+// By default it's only shown on a terminal, where it can be redrawn in place.
+func showProgress() bool {
+	switch progress {
+	case "always":
+		return true
+	case "auto":
+		info, err := os.Stderr.Stat()
+		return err == nil && info.Mode()&os.ModeCharDevice != 0
+	default:
+		return false
+	}
+}
+
+// progressReader counts the bytes read from an input, and reports how far
+// along it is on stderr. If the size of the input isn't known (size < 0),
+// it reports the bytes read so far instead of a percentage.
+type progressReader struct {
+	io.ReadCloser
+	name string
+	size int64
+
+	read     int64
+	lastDraw time.Time
+	spin     int
+}
+
+func newProgressReader(r io.ReadCloser, name string, size int64) *progressReader {
+	return &progressReader{ReadCloser: r, name: name, size: size}
+}
+
+func (pr *progressReader) Read(p []byte) (int, error) {
+	n, err := pr.ReadCloser.Read(p)
+	pr.read += int64(n)
+	if now := time.Now(); now.Sub(pr.lastDraw) >= progressInterval {
+		pr.draw()
+		pr.lastDraw = now
+	}
+	return n, err
+}
+
+func (pr *progressReader) draw() {
+	if pr.size > 0 {
+		fmt.Fprintf(os.Stderr, "\r%s: %3d%%", pr.name, pr.read*100/pr.size)
+	} else {
+		const spinner = `|/-\`
+		fmt.Fprintf(os.Stderr, "\r%s: %c %.1f MB", pr.name, spinner[pr.spin%len(spinner)], float64(pr.read)/1e6)
+		pr.spin++
+	}
+}
+
+func (pr *progressReader) Close() error {
+	if !pr.lastDraw.IsZero() {
+		// Clear the line, so it doesn't run into whatever's printed next.
+		fmt.Fprint(os.Stderr, "\r\033[K")
+	}
+	return pr.ReadCloser.Close()
+}